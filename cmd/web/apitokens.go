@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"go.chat/internal/models"
+	"go.chat/internal/validator"
+)
+
+// apiTokenPrefix starts every API token, telling them apart from access
+// tokens.
+const apiTokenPrefix = "gochat_"
+
+// botEmailDomain gives bots, which never receive mail, a unique address.
+// .invalid is reserved and never resolves.
+const botEmailDomain = "bots.invalid"
+
+// Scopes an API token can be granted. Routes that API tokens may use are
+// wrapped in requireScope with one of these; every other route is closed to
+// them.
+const (
+	scopeRead      = "messages:read"
+	scopeWrite     = "messages:write"
+	scopeJoin      = "chats:join"
+	scopeWebSocket = "ws"
+)
+
+var apiScopes = []string{scopeRead, scopeWrite, scopeJoin, scopeWebSocket}
+
+type createBotForm struct {
+	Username string `json:"username"`
+	validator.Validator
+}
+
+// createAPITokenForm leaves BotID zero for a token acting as the user, and
+// ExpiresIn empty for tokens that never expire. Scopes is a space-separated
+// list.
+type createAPITokenForm struct {
+	Name      string `json:"name"`
+	Scopes    string `json:"scopes"`
+	BotID     int    `json:"bot_id"`
+	ExpiresIn string `json:"expires_in"`
+	validator.Validator
+}
+
+type revokeAPITokenForm struct {
+	TokenID int `json:"token_id"`
+	validator.Validator
+}
+
+// serveWithAPIToken serves the request as the user of the API token if the
+// token is granted scope.
+func (app *application) serveWithAPIToken(w http.ResponseWriter, r *http.Request, token, scope string, next http.Handler) {
+	apiToken, err := app.apiTokens.Authenticate(hashToken(token))
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusUnauthorized)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+	if scope == "" || !slices.Contains(apiToken.Scopes, scope) {
+		app.errorResponse(w, http.StatusForbidden, "insufficient_scope", "The API token is not allowed to make this request", nil)
+		return
+	}
+
+	user, err := app.users.Get(apiToken.UserID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	ctx = context.WithValue(ctx, "user_id", user.ID)
+	ctx = context.WithValue(ctx, "email", user.Email)
+	ctx = context.WithValue(ctx, "api_token_id", apiToken.ID)
+	ctx = context.WithValue(ctx, "api_token_scopes", apiToken.Scopes)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// ownsTokenUser reports whether the user may manage the API tokens acting as
+// tokenUserID: their own and those of their bots.
+func (app *application) ownsTokenUser(userID, tokenUserID int) (bool, error) {
+	if userID == tokenUserID {
+		return true, nil
+	}
+	user, err := app.users.Get(tokenUserID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			return false, nil
+		}
+		return false, err
+	}
+	return user.IsBot && user.OwnerID != nil && *user.OwnerID == userID, nil
+}
+
+func (app *application) createBot(w http.ResponseWriter, r *http.Request) {
+	var form createBotForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in createBot: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Username), "username", "this field cannot be empty")
+	form.CheckField(validator.MaxChars(form.Username, 20), "username", "this field cannot have more than 20 characters long")
+	form.CheckField(!strings.ContainsAny(form.Username, "@ "), "username", "this field cannot contain spaces or @")
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	email := form.Username + "@" + botEmailDomain
+	usernameExist, err := app.users.ExistsUsername(form.Username)
+	if err != nil {
+		app.errorLog.Printf("Error checking username existence: %v", err)
+		app.serverError(w, err)
+		return
+	}
+	emailExist, err := app.users.ExistsEmail(email)
+	if err != nil {
+		app.errorLog.Printf("Error checking email existence: %v", err)
+		app.serverError(w, err)
+		return
+	}
+	if usernameExist || emailExist {
+		form.AddFieldError("username", "username already exists")
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	id, err := app.users.InsertBot(userID, form.Username, email)
+	if err != nil {
+		app.errorLog.Printf("Error inserting bot: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	app.infoLog.Printf("User %d created bot %d", userID, id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":       id,
+		"username": form.Username,
+	})
+}
+
+func (app *application) listBots(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	bots, err := app.users.GetBots(userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting bots of user %d: %v", userID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	resp := make([]map[string]any, 0, len(bots))
+	for _, bot := range bots {
+		resp = append(resp, map[string]any{
+			"id":       bot.ID,
+			"username": bot.Username,
+			"created":  bot.Created,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"bots": resp,
+	})
+}
+
+func (app *application) createAPIToken(w http.ResponseWriter, r *http.Request) {
+	var form createAPITokenForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in createAPIToken: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Name), "name", "this field cannot be empty")
+	form.CheckField(validator.MaxChars(form.Name, 100), "name", "this field cannot have more than 100 characters long")
+	scopes := strings.Fields(form.Scopes)
+	form.CheckField(len(scopes) > 0, "scopes", "this field cannot be empty")
+	for _, scope := range scopes {
+		if !slices.Contains(apiScopes, scope) {
+			form.AddFieldError("scopes", "this field must only list scopes among "+strings.Join(apiScopes, ", "))
+			break
+		}
+	}
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+	form.CheckField(form.BotID >= 0, "bot_id", "this field must be a bot ID")
+	var expiresIn time.Duration
+	if form.ExpiresIn != "" {
+		expiresIn, err = time.ParseDuration(form.ExpiresIn)
+		form.CheckField(err == nil && expiresIn > 0, "expires_in", "this field must be a positive duration such as 720h")
+	}
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	tokenUserID := userID
+	if form.BotID > 0 {
+		owns, err := app.ownsTokenUser(userID, form.BotID)
+		if err != nil {
+			app.errorLog.Printf("Error getting bot %d: %v", form.BotID, err)
+			app.serverError(w, err)
+			return
+		}
+		if !owns {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		tokenUserID = form.BotID
+	}
+
+	var expires *time.Time
+	if expiresIn > 0 {
+		t := time.Now().UTC().Add(expiresIn).Truncate(time.Second)
+		expires = &t
+	}
+
+	secret, _, err := newToken()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	token := apiTokenPrefix + secret
+	id, err := app.apiTokens.Insert(tokenUserID, form.Name, hashToken(token), scopes, expires)
+	if err != nil {
+		app.errorLog.Printf("Error inserting API token: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	app.infoLog.Printf("User %d created API token %d for user %d", userID, id, tokenUserID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":      id,
+		"user_id": tokenUserID,
+		"name":    form.Name,
+		"scopes":  scopes,
+		"expires": expires,
+		"token":   token,
+	})
+}
+
+// listAPITokens lists the usable API tokens of the user and their bots. The
+// tokens themselves are only shown when created.
+func (app *application) listAPITokens(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	tokens, err := app.apiTokens.GetByOwner(userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting API tokens of user %d: %v", userID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"tokens": tokens,
+	})
+}
+
+func (app *application) revokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	var form revokeAPITokenForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in revokeAPIToken: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	form.CheckField(form.TokenID > 0, "token_id", "this field must be an API token ID")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	token, err := app.apiTokens.Get(form.TokenID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error getting API token %d: %v", form.TokenID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	owns, err := app.ownsTokenUser(userID, token.UserID)
+	if err != nil {
+		app.errorLog.Printf("Error getting user %d: %v", token.UserID, err)
+		app.serverError(w, err)
+		return
+	}
+	if !owns {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+
+	err = app.apiTokens.Revoke(token.ID)
+	if err != nil {
+		app.errorLog.Printf("Error revoking API token %d: %v", token.ID, err)
+		app.serverError(w, err)
+		return
+	}
+	app.hub.revokeToken <- token.ID
+
+	app.infoLog.Printf("User %d revoked API token %d", userID, token.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id": token.ID,
+	})
+}
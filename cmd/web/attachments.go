@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.chat/internal/models"
+	"go.chat/internal/storage"
+	"go.chat/internal/validator"
+)
+
+// multipartMemory is how much of a multipart body is kept in memory; larger
+// uploads are spooled to temporary files.
+const multipartMemory = 1 << 20
+
+// allowedUploadTypes lists the media types that can be attached to messages,
+// as sniffed from the file contents. The client's declared type is ignored.
+// Images are served inline, everything else as a download.
+var allowedUploadTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"application/zip": true,
+	"text/plain":      true,
+}
+
+type uploadConfig struct {
+	maxSize  int64
+	maxFiles int
+	// timeout replaces the usual request timeout for multipart requests, so
+	// that large uploads have time to arrive.
+	timeout time.Duration
+}
+
+// maxBody is the largest multipart request body accepted by sendMessage.
+func (c uploadConfig) maxBody() int64 {
+	return int64(c.maxFiles)*c.maxSize + multipartMemory
+}
+
+// checkUploads validates the files of form against the upload limits and
+// returns their sniffed content types. Problems are recorded as field errors
+// on form.
+func (app *application) checkUploads(form *createMessageForm) ([]string, error) {
+	cfg := app.uploads
+	form.CheckField(len(form.Files) <= cfg.maxFiles, "file", fmt.Sprintf("no more than %d files can be attached", cfg.maxFiles))
+
+	types := make([]string, len(form.Files))
+	for i, fh := range form.Files {
+		if fh.Size > cfg.maxSize {
+			form.AddFieldError("file", fmt.Sprintf("%s is larger than %d bytes", fh.Filename, cfg.maxSize))
+			continue
+		}
+
+		contentType, err := sniffContentType(fh)
+		if err != nil {
+			return nil, err
+		}
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if !allowedUploadTypes[mediaType] {
+			form.AddFieldError("file", fmt.Sprintf("%s has an unsupported file type", fh.Filename))
+			continue
+		}
+		types[i] = contentType
+	}
+	return types, nil
+}
+
+func sniffContentType(fh *multipart.FileHeader) (string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// storeUploads copies the files to the blob store under the chat and returns
+// the attachments to record once the message is stored. Nothing is left in
+// the store when it fails.
+func (app *application) storeUploads(chatID int, files []*multipart.FileHeader, types []string) ([]*models.Attachment, error) {
+	attachments := make([]*models.Attachment, 0, len(files))
+	for i, fh := range files {
+		key, err := newStorageKey(chatID)
+		if err != nil {
+			app.deleteBlobs(attachmentKeys(attachments))
+			return nil, err
+		}
+
+		f, err := fh.Open()
+		if err != nil {
+			app.deleteBlobs(attachmentKeys(attachments))
+			return nil, err
+		}
+		err = app.blobs.Put(context.Background(), key, f, fh.Size, types[i])
+		f.Close()
+		if err != nil {
+			app.deleteBlobs(attachmentKeys(attachments))
+			return nil, err
+		}
+
+		attachments = append(attachments, &models.Attachment{
+			Filename:    uploadFilename(fh.Filename),
+			ContentType: types[i],
+			Size:        fh.Size,
+			StorageKey:  key,
+		})
+	}
+	return attachments, nil
+}
+
+// saveAttachments records the stored uploads as attachments of the message.
+// On failure the blobs are removed again.
+func (app *application) saveAttachments(messageID int, attachments []*models.Attachment) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	err := app.attachments.Insert(messageID, attachments)
+	if err != nil {
+		app.errorLog.Printf("Error inserting attachments of message %d: %v", messageID, err)
+		app.deleteBlobs(attachmentKeys(attachments))
+		return err
+	}
+	return nil
+}
+
+// deleteBlobs removes blobs from the store, logging failures.
+func (app *application) deleteBlobs(keys []string) {
+	for _, key := range keys {
+		err := app.blobs.Delete(context.Background(), key)
+		if err != nil {
+			app.errorLog.Printf("Error deleting blob %s: %v", key, err)
+		}
+	}
+}
+
+func attachmentKeys(attachments []*models.Attachment) []string {
+	keys := make([]string, len(attachments))
+	for i, a := range attachments {
+		keys[i] = a.StorageKey
+	}
+	return keys
+}
+
+func newStorageKey(chatID int) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("chats/%d/%s", chatID, hex.EncodeToString(b)), nil
+}
+
+// uploadFilename strips any directory from the client's file name and keeps
+// it within the length of the filename column.
+func uploadFilename(name string) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, `\`, "/")))
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	if !validator.MaxChars(name, 255) {
+		return string([]rune(name)[:255])
+	}
+	return name
+}
+
+// downloadAttachment serves an attachment to the members of its chat.
+func (app *application) downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	attachmentID, err := strconv.Atoi(params.ByName("attachment_id"))
+	if err != nil {
+		app.errorLog.Printf("Error parsing attachment_id: %v", err)
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	attachment, err := app.attachments.Get(attachmentID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error getting attachment %d: %v", attachmentID, err)
+		app.serverError(w, err)
+		return
+	}
+	if attachment.MessageDeleted {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	_, err = app.authorize(attachment.ChatID, userID, permRead)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot read chat %d: %v", userID, attachment.ChatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+
+	body, err := app.blobs.Get(r.Context(), attachment.StorageKey)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			app.errorLog.Printf("Blob of attachment %d is missing", attachment.ID)
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error opening blob of attachment %d: %v", attachment.ID, err)
+		app.serverError(w, err)
+		return
+	}
+	defer body.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.ContentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, body)
+	if err != nil {
+		app.errorLog.Printf("Error sending attachment %d: %v", attachment.ID, err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.chat/internal/models"
+	"go.chat/internal/validator"
+)
+
+const (
+	accessCookie  = "token"
+	refreshCookie = "refresh_token"
+	// refreshCookiePath keeps the refresh token from being sent anywhere
+	// but the /user endpoints.
+	refreshCookiePath = "/user"
+)
+
+// newToken returns a random opaque token and the hash under which it is
+// stored.
+func newToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// refreshTokenForm lets clients that do not keep cookies send their refresh
+// token in the body.
+type refreshTokenForm struct {
+	RefreshToken string `json:"refresh_token"`
+	validator.Validator
+}
+
+// startSession logs the user in: it creates a session, sets the access and
+// refresh token cookies and returns both tokens for clients that do not keep
+// cookies.
+func (app *application) startSession(w http.ResponseWriter, userID int, email string) (access, refresh string, err error) {
+	refresh, hash, err := newToken()
+	if err != nil {
+		return "", "", err
+	}
+	expires := time.Now().UTC().Add(app.refreshTTL)
+	sessionID, err := app.sessions.Insert(userID, hash, expires)
+	if err != nil {
+		return "", "", err
+	}
+	access, err = app.setAuthCookies(w, userID, email, sessionID, refresh, expires)
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// refreshToken returns the refresh token sent in the request body, or
+// failing that in the refresh token cookie, or an empty string. ok is false
+// when the body was invalid and the response has been written.
+func (app *application) refreshToken(w http.ResponseWriter, r *http.Request) (token string, ok bool) {
+	var form refreshTokenForm
+	if r.ContentLength != 0 {
+		err := app.decodeForm(w, r, &form)
+		if err != nil {
+			app.errorLog.Printf("Error decoding refresh token: %v", err)
+			app.decodeError(w, err)
+			return "", false
+		}
+		if !form.Valid() {
+			app.invalidForm(w, form.FieldErrors)
+			return "", false
+		}
+	}
+	if form.RefreshToken != "" {
+		return form.RefreshToken, true
+	}
+	if cookie, err := r.Cookie(refreshCookie); err == nil {
+		return cookie.Value, true
+	}
+	return "", true
+}
+
+// setAuthCookies issues an access token for the session and sets it and the
+// refresh token as cookies. It returns the access token.
+func (app *application) setAuthCookies(w http.ResponseWriter, userID int, email string, sessionID int, refresh string, refreshExpires time.Time) (string, error) {
+	access, err := app.jwt.GenerateToken(userID, email, sessionID)
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessCookie,
+		Value:    access,
+		Path:     "/",
+		MaxAge:   int(app.jwt.TTL().Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    refresh,
+		Path:     refreshCookiePath,
+		MaxAge:   int(time.Until(refreshExpires).Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return access, nil
+}
+
+func clearAuthCookies(w http.ResponseWriter) {
+	for name, path := range map[string]string{accessCookie: "/", refreshCookie: refreshCookiePath} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     path,
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// userRefresh exchanges a refresh token for a new access token and a new
+// refresh token. Refresh tokens are single use: presenting one twice revokes
+// the session it belongs to.
+func (app *application) userRefresh(w http.ResponseWriter, r *http.Request) {
+	token, ok := app.refreshToken(w, r)
+	if !ok {
+		return
+	}
+	if token == "" {
+		app.clientError(w, http.StatusUnauthorized)
+		return
+	}
+
+	refresh, hash, err := newToken()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	expires := time.Now().UTC().Add(app.refreshTTL)
+
+	sessionID, userID, err := app.sessions.Rotate(hashToken(token), hash, expires)
+	if err != nil {
+		switch err {
+		case models.ErrNoRecord:
+			clearAuthCookies(w)
+			app.clientError(w, http.StatusUnauthorized)
+		case models.ErrTokenReused:
+			app.errorLog.Printf("Refresh token reused, revoked session %d of user %d", sessionID, userID)
+			app.hub.revoke <- sessionID
+			clearAuthCookies(w)
+			app.clientError(w, http.StatusUnauthorized)
+		default:
+			app.errorLog.Printf("Error rotating refresh token: %v", err)
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	user, err := app.users.Get(userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting user %d: %v", userID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	access, err := app.setAuthCookies(w, user.ID, user.Email, sessionID, refresh, expires)
+	if err != nil {
+		app.errorLog.Printf("Error generating JWT token: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":            user.ID,
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int(app.jwt.TTL().Seconds()),
+		"refresh_token": refresh,
+	})
+}
+
+// userLogout revokes the session of the refresh token, sent in the body or
+// its cookie, or failing that of the access token, sent in an Authorization
+// header or its cookie. It clears both cookies and closes the session's
+// WebSocket connections.
+func (app *application) userLogout(w http.ResponseWriter, r *http.Request) {
+	token, ok := app.refreshToken(w, r)
+	if !ok {
+		return
+	}
+
+	sessionID := 0
+	if token != "" {
+		id, err := app.sessions.GetIDByToken(hashToken(token))
+		if err != nil && err != models.ErrNoRecord {
+			app.errorLog.Printf("Error getting session of refresh token: %v", err)
+			app.serverError(w, err)
+			return
+		}
+		sessionID = id
+	}
+	if sessionID == 0 {
+		access, ok, _ := bearerToken(r)
+		if !ok {
+			if cookie, err := r.Cookie(accessCookie); err == nil {
+				access = cookie.Value
+			}
+		}
+		if claims, err := app.jwt.ValidateToken(access); err == nil {
+			sessionID = claims.SessionID
+		}
+	}
+
+	if sessionID > 0 {
+		err := app.sessions.Revoke(sessionID)
+		if err != nil {
+			app.errorLog.Printf("Error revoking session %d: %v", sessionID, err)
+			app.serverError(w, err)
+			return
+		}
+		app.hub.revoke <- sessionID
+		app.infoLog.Printf("Session %d logged out", sessionID)
+	}
+
+	clearAuthCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// jwks publishes the public keys tokens are signed with, so that other
+// services can verify them.
+func (app *application) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": app.jwt.JWKS(),
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+
+	"go.chat/internal/models"
+)
+
+const (
+	hookTimeout         = 5 * time.Second
+	hookMaxResponse     = 64 << 10
+	hookSignatureHeader = "X-GoChat-Signature"
+)
+
+var commandNameRX = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// hookCommandConfig is an entry of the -commands file: a custom command
+// answered by an HTTP endpoint. Non-ephemeral responses are posted as the
+// bot BotID, which must be a member of the chat.
+type hookCommandConfig struct {
+	Name        string `json:"name"`
+	Usage       string `json:"usage"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	// Secret, if set, signs requests with an HMAC-SHA256 of the body in the
+	// X-GoChat-Signature header.
+	Secret string `json:"secret"`
+	BotID  int    `json:"bot_id"`
+}
+
+// hookRequest is the JSON body POSTed to a custom command's endpoint.
+type hookRequest struct {
+	Command  string `json:"command"`
+	Args     string `json:"args"`
+	ChatID   int    `json:"chat_id"`
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// hookResponse is the JSON answer of a custom command's endpoint. Text is
+// posted to the chat, or only shown to the caller if Ephemeral is set.
+type hookResponse struct {
+	Text      string `json:"text"`
+	Ephemeral bool   `json:"ephemeral"`
+}
+
+// loadHookCommands registers the custom commands listed in the JSON file at
+// path, checking that their bots exist.
+func (r *commandRegistry) loadHookCommands(path string, users *models.UserModel) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var configs []hookCommandConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&configs)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	client := &http.Client{Timeout: hookTimeout}
+	for _, cfg := range configs {
+		if !commandNameRX.MatchString(cfg.Name) {
+			return fmt.Errorf("%s: invalid command name %q", path, cfg.Name)
+		}
+		u, err := url.Parse(cfg.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: /%s: url must be an http or https URL", path, cfg.Name)
+		}
+		bot, err := users.Get(cfg.BotID)
+		if err != nil && err != models.ErrNoRecord {
+			return err
+		}
+		if err == models.ErrNoRecord || !bot.IsBot {
+			return fmt.Errorf("%s: /%s: bot_id must be the ID of a bot", path, cfg.Name)
+		}
+		if cfg.Description == "" {
+			cfg.Description = "Custom command"
+		}
+
+		hook := hookCommand{config: cfg, client: client}
+		err = r.register(&command{
+			name:        cfg.Name,
+			usage:       cfg.Usage,
+			description: cfg.Description,
+			perm:        permPost,
+			run:         hook.run,
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+type hookCommand struct {
+	config hookCommandConfig
+	client *http.Client
+}
+
+// run calls the command's endpoint in the background, so that a slow
+// endpoint holds up neither the request nor the caller's connection, and
+// answers that the command is pending.
+func (h hookCommand) run(app *application, call *commandCall) (*submitResult, error) {
+	user, err := app.users.Get(call.userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting user %d: %v", call.userID, err)
+		return nil, err
+	}
+
+	go h.respond(app, hookRequest{
+		Command:  h.config.Name,
+		Args:     call.args,
+		ChatID:   call.chatID,
+		UserID:   call.userID,
+		Username: user.Username,
+	})
+	return &submitResult{pending: true}, nil
+}
+
+// respond calls the command's endpoint and posts its response as the
+// command's bot. Ephemeral responses and failures are sent to the caller's
+// WebSocket connections in a "command" frame.
+func (h hookCommand) respond(app *application, payload hookRequest) {
+	name := h.config.Name
+	resp, err := h.call(payload)
+	if err != nil {
+		app.errorLog.Printf("Error calling endpoint of /%s: %v", name, err)
+		h.reply(app, payload, "/"+name+" failed, try again later")
+		return
+	}
+	if resp.Text == "" {
+		return
+	}
+	if resp.Ephemeral {
+		h.reply(app, payload, resp.Text)
+		return
+	}
+
+	form := &createMessageForm{ChatID: payload.ChatID, Content: resp.Text}
+	_, err = app.postMessage(form, h.config.BotID)
+	switch err {
+	case nil:
+	case errInvalidForm:
+		app.errorLog.Printf("Invalid response from endpoint of /%s: %v", name, form.FieldErrors)
+		h.reply(app, payload, "/"+name+" returned a message that cannot be posted")
+	case errChatNotFound, errNotParticipant, errForbidden, errMuted:
+		h.reply(app, payload, "the bot of /"+name+" cannot post in this chat")
+	default:
+		app.errorLog.Printf("Error posting response of /%s: %v", name, err)
+		h.reply(app, payload, "/"+name+" failed, try again later")
+	}
+}
+
+// reply sends text to the caller's connections subscribed to the chat.
+func (h hookCommand) reply(app *application, payload hookRequest, text string) {
+	frame, err := json.Marshal(Message{Type: "command", ChatID: payload.ChatID, UserID: payload.UserID, Content: text})
+	if err != nil {
+		app.errorLog.Printf("Error marshaling reply of /%s: %v", h.config.Name, err)
+		return
+	}
+	app.hub.sendToChatUsers(payload.ChatID, []int{payload.UserID}, frame)
+}
+
+func (h hookCommand) call(payload hookRequest) (*hookResponse, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.config.Secret))
+		mac.Write(body)
+		req.Header.Set(hookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if res.StatusCode == http.StatusNoContent {
+		return &hookResponse{}, nil
+	}
+
+	var resp hookResponse
+	err = json.NewDecoder(io.LimitReader(res.Body, hookMaxResponse)).Decode(&resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.chat/internal/models"
+	"go.chat/internal/validator"
+)
+
+const defaultMuteDuration = time.Hour
+
+// command is a slash command: a message starting with "/" that is run
+// instead of being posted.
+type command struct {
+	name string
+	// usage describes the arguments for /help and usage errors.
+	usage       string
+	description string
+	// perm is checked against the caller's role before run is called.
+	perm permission
+	run  func(app *application, call *commandCall) (*submitResult, error)
+}
+
+// commandCall is one invocation of a command. Usage errors are reported as
+// field errors on the content of form.
+type commandCall struct {
+	form   *createMessageForm
+	chatID int
+	userID int
+	role   string
+	args   string
+}
+
+func (call *commandCall) usageError(cmd *command) error {
+	call.form.AddFieldError("content", strings.TrimSpace("usage: /"+cmd.name+" "+cmd.usage))
+	return errInvalidForm
+}
+
+// submitResult is the outcome of a message or command sent by a user:
+// message is what was posted to the chat, if anything, and reply text for
+// the user alone. pending is set by commands that answer later.
+type submitResult struct {
+	message *models.Message
+	command string
+	reply   string
+	pending bool
+}
+
+// commandRegistry holds the slash commands by name. It is filled in at
+// startup and only read afterwards.
+type commandRegistry struct {
+	commands map[string]*command
+}
+
+// newCommandRegistry returns a registry with the built-in commands.
+func newCommandRegistry() *commandRegistry {
+	r := &commandRegistry{commands: make(map[string]*command)}
+	for _, cmd := range []*command{
+		{name: "help", description: "List the commands you can use", perm: permRead, run: runHelp},
+		{name: "me", usage: "<action>", description: "Describe what you are doing", perm: permPost, run: runMe},
+		{name: "topic", usage: "<topic>", description: "Set the topic of the chat", perm: permSetTopic, run: runTopic},
+		{name: "invite", usage: "<username>", description: "Add a user to the chat", perm: permManageMembers, run: runInvite},
+		{name: "mute", usage: "<username> [duration]", description: "Keep a member from posting, for an hour by default", perm: permManageMembers, run: runMute},
+		{name: "unmute", usage: "<username>", description: "Let a muted member post again", perm: permManageMembers, run: runUnmute},
+	} {
+		r.register(cmd)
+	}
+	return r
+}
+
+func (r *commandRegistry) register(cmd *command) error {
+	if _, exists := r.commands[cmd.name]; exists {
+		return fmt.Errorf("command /%s is already registered", cmd.name)
+	}
+	r.commands[cmd.name] = cmd
+	return nil
+}
+
+// sorted returns the commands ordered by name.
+func (r *commandRegistry) sorted() []*command {
+	commands := make([]*command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		commands = append(commands, cmd)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].name < commands[j].name
+	})
+	return commands
+}
+
+// parseCommand splits a message of the form "/name args".
+func parseCommand(content string) (name, args string, ok bool) {
+	rest, ok := strings.CutPrefix(content, "/")
+	if !ok {
+		return "", "", false
+	}
+	i := strings.IndexFunc(rest, unicode.IsSpace)
+	if i < 0 {
+		i = len(rest)
+	}
+	name, args = rest[:i], strings.TrimSpace(rest[i:])
+	return strings.ToLower(name), args, name != ""
+}
+
+// submitMessage posts the message of form, or runs it as a command when it
+// starts with "/". A message starting with "//" is posted with the first
+// slash removed. It is shared by sendMessage and the WebSocket "message"
+// frame. When errInvalidForm is returned the details are in form.FieldErrors.
+func (app *application) submitMessage(form *createMessageForm, userID int) (*submitResult, error) {
+	if strings.HasPrefix(form.Content, "//") {
+		form.Content = form.Content[1:]
+	} else if name, args, ok := parseCommand(form.Content); ok {
+		return app.runCommand(form, userID, name, args)
+	}
+
+	message, err := app.postMessage(form, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &submitResult{message: message}, nil
+}
+
+func (app *application) runCommand(form *createMessageForm, userID int, name, args string) (*submitResult, error) {
+	cmd, ok := app.commands.commands[name]
+	form.CheckField(ok, "content", "unknown command /"+name+", see /help")
+	form.CheckField(form.ParentID == 0 && len(form.Files) == 0, "content", "commands cannot be sent in threads or with attachments")
+	if !form.Valid() {
+		return nil, errInvalidForm
+	}
+
+	role, err := app.authorize(form.ChatID, userID, cmd.perm)
+	if err != nil {
+		return nil, err
+	}
+	// Commands that post, such as custom commands whose bot posts for the
+	// caller, are closed to muted members.
+	if cmd.perm == permPost {
+		err = app.checkNotMuted(form.ChatID, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := cmd.run(app, &commandCall{
+		form:   form,
+		chatID: form.ChatID,
+		userID: userID,
+		role:   role,
+		args:   args,
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.command = name
+	app.infoLog.Printf("User %d ran /%s in chat %d", userID, name, form.ChatID)
+	return result, nil
+}
+
+func runHelp(app *application, call *commandCall) (*submitResult, error) {
+	var b strings.Builder
+	for _, cmd := range app.commands.sorted() {
+		if roleRank(call.role) < roleRank(requiredRole[cmd.perm]) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(strings.TrimSpace("/" + cmd.name + " " + cmd.usage))
+		b.WriteString(" - " + cmd.description)
+	}
+	return &submitResult{reply: b.String()}, nil
+}
+
+func runMe(app *application, call *commandCall) (*submitResult, error) {
+	if call.args == "" {
+		return nil, call.usageError(app.commands.commands["me"])
+	}
+	user, err := app.users.Get(call.userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting user %d: %v", call.userID, err)
+		return nil, err
+	}
+
+	call.form.Content = "_" + user.Username + " " + call.args + "_"
+	message, err := app.postMessage(call.form, call.userID)
+	if err != nil {
+		return nil, err
+	}
+	return &submitResult{message: message}, nil
+}
+
+func runTopic(app *application, call *commandCall) (*submitResult, error) {
+	if call.args == "" {
+		return nil, call.usageError(app.commands.commands["topic"])
+	}
+	call.form.CheckField(validator.MaxChars(call.args, 250), "content", "the topic cannot have more than 250 characters")
+	if !call.form.Valid() {
+		return nil, errInvalidForm
+	}
+
+	user, err := app.users.Get(call.userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting user %d: %v", call.userID, err)
+		return nil, err
+	}
+	err = app.chats.SetTopic(call.chatID, call.args)
+	if err != nil {
+		app.errorLog.Printf("Error setting topic of chat %d: %v", call.chatID, err)
+		return nil, err
+	}
+	err = app.postSystemMessage(call.chatID, call.userID, user.Username+" set the topic to: "+call.args)
+	if err != nil {
+		return nil, err
+	}
+	return &submitResult{}, nil
+}
+
+func runInvite(app *application, call *commandCall) (*submitResult, error) {
+	cmd := app.commands.commands["invite"]
+	username, rest := splitArg(call.args)
+	if username == "" || rest != "" {
+		return nil, call.usageError(cmd)
+	}
+	member, err := app.commandUser(call, username)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := app.participants.Exists(call.chatID, member.ID)
+	if err != nil {
+		app.errorLog.Printf("Error checking participant: %v", err)
+		return nil, err
+	}
+	if exists {
+		call.form.AddFieldError("content", member.Username+" is already in this chat")
+		return nil, errInvalidForm
+	}
+
+	admin, err := app.users.Get(call.userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting user %d: %v", call.userID, err)
+		return nil, err
+	}
+	_, err = app.participants.Insert(call.chatID, member.ID, models.RoleMember)
+	if err != nil {
+		app.errorLog.Printf("Error adding user %d to chat %d: %v", member.ID, call.chatID, err)
+		return nil, err
+	}
+	app.hub.join <- membership{userID: member.ID, chatID: call.chatID}
+
+	err = app.postSystemMessage(call.chatID, member.ID, admin.Username+" added "+member.Username)
+	if err != nil {
+		return nil, err
+	}
+	return &submitResult{}, nil
+}
+
+func runMute(app *application, call *commandCall) (*submitResult, error) {
+	cmd := app.commands.commands["mute"]
+	username, rest := splitArg(call.args)
+	if username == "" {
+		return nil, call.usageError(cmd)
+	}
+	duration := defaultMuteDuration
+	if rest != "" {
+		d, err := time.ParseDuration(rest)
+		if err != nil || d <= 0 {
+			call.form.AddFieldError("content", "the duration must be positive, such as 30m or 24h")
+			return nil, errInvalidForm
+		}
+		duration = d
+	}
+
+	admin, member, err := app.commandMember(call, username)
+	if err != nil {
+		return nil, err
+	}
+	until := time.Now().UTC().Add(duration).Truncate(time.Second)
+	err = app.participants.SetMutedUntil(call.chatID, member.ID, &until)
+	if err != nil {
+		app.errorLog.Printf("Error muting user %d in chat %d: %v", member.ID, call.chatID, err)
+		return nil, err
+	}
+
+	err = app.postSystemMessage(call.chatID, member.ID, admin.Username+" muted "+member.Username+" for "+formatDuration(duration))
+	if err != nil {
+		return nil, err
+	}
+	return &submitResult{}, nil
+}
+
+func runUnmute(app *application, call *commandCall) (*submitResult, error) {
+	cmd := app.commands.commands["unmute"]
+	username, rest := splitArg(call.args)
+	if username == "" || rest != "" {
+		return nil, call.usageError(cmd)
+	}
+
+	admin, member, err := app.commandMember(call, username)
+	if err != nil {
+		return nil, err
+	}
+	err = app.participants.SetMutedUntil(call.chatID, member.ID, nil)
+	if err != nil {
+		app.errorLog.Printf("Error unmuting user %d in chat %d: %v", member.ID, call.chatID, err)
+		return nil, err
+	}
+
+	err = app.postSystemMessage(call.chatID, member.ID, admin.Username+" unmuted "+member.Username)
+	if err != nil {
+		return nil, err
+	}
+	return &submitResult{}, nil
+}
+
+// commandUser returns the user named by a command argument, which may start
+// with "@".
+func (app *application) commandUser(call *commandCall, username string) (*models.User, error) {
+	username = strings.TrimPrefix(username, "@")
+	user, err := app.users.GetByUsername(username)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			call.form.AddFieldError("content", "there is no user named "+username)
+			return nil, errInvalidForm
+		}
+		app.errorLog.Printf("Error getting user %s: %v", username, err)
+		return nil, err
+	}
+	return user, nil
+}
+
+// commandMember returns the caller and the member named by a command
+// argument, checking that the caller's role ranks above the member's.
+func (app *application) commandMember(call *commandCall, username string) (caller, member *models.User, err error) {
+	member, err = app.commandUser(call, username)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	memberRole, err := app.participants.GetRole(call.chatID, member.ID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			call.form.AddFieldError("content", member.Username+" is not in this chat")
+			return nil, nil, errInvalidForm
+		}
+		app.errorLog.Printf("Error getting role of user %d in chat %d: %v", member.ID, call.chatID, err)
+		return nil, nil, err
+	}
+	if roleRank(memberRole) >= roleRank(call.role) {
+		return nil, nil, errForbidden
+	}
+
+	caller, err = app.users.Get(call.userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting user %d: %v", call.userID, err)
+		return nil, nil, err
+	}
+	return caller, member, nil
+}
+
+// splitArg returns the first word of args and the rest.
+func splitArg(args string) (first, rest string) {
+	first, rest, _ = strings.Cut(args, " ")
+	return first, strings.TrimSpace(rest)
+}
+
+// formatDuration prints d without the zero units time.Duration.String adds,
+// as in "1h" rather than "1h0m0s".
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		content string
+		name    string
+		args    string
+		ok      bool
+	}{
+		{content: "/help", name: "help", ok: true},
+		{content: "/me waves", name: "me", args: "waves", ok: true},
+		{content: "/MUTE  @bob   2h ", name: "mute", args: "@bob   2h", ok: true},
+		{content: "/topic\tRelease plan", name: "topic", args: "Release plan", ok: true},
+		{content: "/topic\nline one\nline two", name: "topic", args: "line one\nline two", ok: true},
+		{content: "/", ok: false},
+		{content: "/ help", ok: false},
+		{content: "help", ok: false},
+		{content: " /help", ok: false},
+		{content: "", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			name, args, ok := parseCommand(tt.content)
+			if ok != tt.ok {
+				t.Fatalf("got ok %t; want %t", ok, tt.ok)
+			}
+			if ok && (name != tt.name || args != tt.args) {
+				t.Errorf("got name %q, args %q; want %q, %q", name, args, tt.name, tt.args)
+			}
+		})
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{d: time.Hour, want: "1h"},
+		{d: 24 * time.Hour, want: "24h"},
+		{d: 90 * time.Minute, want: "1h30m"},
+		{d: time.Hour + 30*time.Second, want: "1h0m30s"},
+		{d: 30 * time.Minute, want: "30m"},
+		{d: 45 * time.Second, want: "45s"},
+		{d: 1500 * time.Millisecond, want: "1.5s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatDuration(tt.d); got != tt.want {
+				t.Errorf("formatDuration(%v) = %q; want %q", tt.d, got, tt.want)
+			}
+		})
+	}
+}
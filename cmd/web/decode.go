@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// maxFormBytes limits the size of request bodies other than message uploads.
+const maxFormBytes = 1 << 20
+
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// errUnsupportedFieldType means a form has a field of a type decodeValues
+// cannot set, which is a bug rather than a bad request.
+var errUnsupportedFieldType = errors.New("unsupported form field type")
+
+// fieldErrorAdder is implemented by the forms, through their embedded
+// validator.Validator.
+type fieldErrorAdder interface {
+	AddFieldError(key, message string)
+}
+
+// decodeForm fills form, a pointer to one of the form structs, from a JSON,
+// URL-encoded or multipart request body. Fields are named by their json tags
+// in every encoding, and fields tagged "-" are never set from the body.
+// Unknown fields and values of the wrong type are recorded as field errors
+// on form; the returned error is only set when the body could not be read
+// at all, or form cannot be decoded, and is meant for decodeError.
+func (app *application) decodeForm(w http.ResponseWriter, r *http.Request, form fieldErrorAdder) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormBytes)
+
+	mediaType := "application/x-www-form-urlencoded"
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(ct)
+		if err != nil {
+			return errUnsupportedMediaType
+		}
+	}
+
+	switch mediaType {
+	case "application/json":
+		return decodeJSON(r.Body, form)
+	case "multipart/form-data":
+		// sendMessage parses multipart bodies itself with a larger limit.
+		if r.MultipartForm == nil {
+			err := r.ParseMultipartForm(multipartMemory)
+			if err != nil {
+				return err
+			}
+		}
+		return decodeValues(r.MultipartForm.Value, form)
+	case "application/x-www-form-urlencoded":
+		// ParseForm ignores bodies without a Content-Type.
+		if r.Header.Get("Content-Type") == "" {
+			r.Header.Set("Content-Type", mediaType)
+		}
+		err := r.ParseForm()
+		if err != nil {
+			return err
+		}
+		return decodeValues(r.PostForm, form)
+	default:
+		return errUnsupportedMediaType
+	}
+}
+
+// decodeError writes the response for an error returned by decodeForm.
+func (app *application) decodeError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		app.clientError(w, http.StatusRequestEntityTooLarge)
+	case err == errUnsupportedMediaType:
+		app.clientError(w, http.StatusUnsupportedMediaType)
+	case errors.Is(err, errUnsupportedFieldType):
+		app.serverError(w, err)
+	default:
+		app.clientError(w, http.StatusBadRequest)
+	}
+}
+
+func decodeJSON(body io.Reader, form fieldErrorAdder) error {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(form)
+	if err == nil {
+		if dec.More() {
+			form.AddFieldError("body", "body must only contain a single JSON object")
+		}
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return err
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		form.AddFieldError("body", "body contains badly-formed JSON")
+	case errors.Is(err, io.EOF):
+		form.AddFieldError("body", "body cannot be empty")
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			form.AddFieldError("body", "body must be a JSON object")
+		} else {
+			form.AddFieldError(typeErr.Field, typeMessage(typeErr.Type))
+		}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		name := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		form.AddFieldError(name, "this field is not allowed")
+	default:
+		return err
+	}
+	return nil
+}
+
+// decodeValues sets the fields of form from URL-encoded or multipart values,
+// converting them to the field types. It returns errUnsupportedFieldType if
+// form has a tagged field of a type it cannot set.
+func decodeValues(values url.Values, form fieldErrorAdder) error {
+	v := reflect.ValueOf(form).Elem()
+	t := v.Type()
+
+	known := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		known[name] = true
+
+		field := v.Field(i)
+		kind := field.Kind()
+		if kind == reflect.Pointer {
+			kind = field.Type().Elem().Kind()
+		}
+		if kind != reflect.String && kind != reflect.Int && kind != reflect.Bool {
+			return fmt.Errorf("%w: %s.%s is %s", errUnsupportedFieldType, t.Name(), t.Field(i).Name, field.Type())
+		}
+
+		vals, ok := values[name]
+		if !ok {
+			continue
+		}
+		if field.Kind() == reflect.Pointer {
+			field.Set(reflect.New(field.Type().Elem()))
+			field = field.Elem()
+		}
+
+		s := vals[0]
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(s)
+		case reflect.Int:
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				form.AddFieldError(name, typeMessage(field.Type()))
+				continue
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				form.AddFieldError(name, typeMessage(field.Type()))
+				continue
+			}
+			field.SetBool(b)
+		}
+	}
+
+	for name := range values {
+		if !known[name] {
+			form.AddFieldError(name, "this field is not allowed")
+		}
+	}
+	return nil
+}
+
+func typeMessage(t reflect.Type) string {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int:
+		return "this field must be an integer"
+	case reflect.Bool:
+		return "this field must be true or false"
+	case reflect.String:
+		return "this field must be a string"
+	default:
+		return "this field has the wrong type"
+	}
+}
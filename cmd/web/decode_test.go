@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.chat/internal/validator"
+)
+
+type testForm struct {
+	Name     string `json:"name"`
+	Count    int    `json:"count"`
+	Public   bool   `json:"public"`
+	ParentID *int   `json:"parent_id,omitempty"`
+	Internal string `json:"-"`
+	validator.Validator
+}
+
+func TestDecodeForm(t *testing.T) {
+	intPtr := func(n int) *int { return &n }
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        testForm
+		errors      map[string]string
+		err         error
+	}{
+		{
+			name:        "JSON",
+			contentType: "application/json",
+			body:        `{"name": "go", "count": 3, "public": true, "parent_id": 7}`,
+			want:        testForm{Name: "go", Count: 3, Public: true, ParentID: intPtr(7)},
+		},
+		{
+			name:        "URL-encoded",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "name=go&count=3&public=true&parent_id=7",
+			want:        testForm{Name: "go", Count: 3, Public: true, ParentID: intPtr(7)},
+		},
+		{
+			name: "URL-encoded by default",
+			body: "name=go",
+			want: testForm{Name: "go"},
+		},
+		{
+			name:        "Media type parameters",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"count": 1}`,
+			want:        testForm{Count: 1},
+		},
+		{
+			name:        "JSON wrong type",
+			contentType: "application/json",
+			body:        `{"count": "three"}`,
+			errors:      map[string]string{"count": "this field must be an integer"},
+		},
+		{
+			name:        "JSON unknown field",
+			contentType: "application/json",
+			body:        `{"Internal": "x"}`,
+			errors:      map[string]string{"Internal": "this field is not allowed"},
+		},
+		{
+			name:        "JSON badly-formed",
+			contentType: "application/json",
+			body:        `{"name": `,
+			errors:      map[string]string{"body": "body contains badly-formed JSON"},
+		},
+		{
+			name:        "JSON empty",
+			contentType: "application/json",
+			errors:      map[string]string{"body": "body cannot be empty"},
+		},
+		{
+			name:        "JSON not an object",
+			contentType: "application/json",
+			body:        `[1, 2]`,
+			errors:      map[string]string{"body": "body must be a JSON object"},
+		},
+		{
+			name:        "JSON several objects",
+			contentType: "application/json",
+			body:        `{"name": "a"} {"name": "b"}`,
+			want:        testForm{Name: "a"},
+			errors:      map[string]string{"body": "body must only contain a single JSON object"},
+		},
+		{
+			name:        "URL-encoded wrong types",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "count=three&public=maybe&parent_id=x",
+			errors: map[string]string{
+				"count":     "this field must be an integer",
+				"public":    "this field must be true or false",
+				"parent_id": "this field must be an integer",
+			},
+		},
+		{
+			name:        "URL-encoded untagged field",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "Internal=x",
+			errors:      map[string]string{"Internal": "this field is not allowed"},
+		},
+		{
+			name:        "Unsupported media type",
+			contentType: "text/plain",
+			body:        "name=go",
+			err:         errUnsupportedMediaType,
+		},
+		{
+			name:        "Malformed media type",
+			contentType: "application/",
+			err:         errUnsupportedMediaType,
+		},
+	}
+
+	app := &application{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+
+			var form testForm
+			err := app.decodeForm(httptest.NewRecorder(), r, &form)
+			if err != tt.err {
+				t.Fatalf("got error %v; want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(form.FieldErrors) != len(tt.errors) {
+				t.Errorf("got field errors %v; want %v", form.FieldErrors, tt.errors)
+			}
+			for field, message := range tt.errors {
+				if form.FieldErrors[field] != message {
+					t.Errorf("got %s error %q; want %q", field, form.FieldErrors[field], message)
+				}
+			}
+			if form.Name != tt.want.Name || form.Count != tt.want.Count || form.Public != tt.want.Public {
+				t.Errorf("got %+v; want %+v", form, tt.want)
+			}
+			if tt.errors == nil {
+				checkCursor(t, "parent_id", form.ParentID, tt.want.ParentID)
+			}
+		})
+	}
+}
+
+func TestDecodeFormTooLarge(t *testing.T) {
+	body := `{"name": "` + strings.Repeat("a", maxFormBytes) + `"}`
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+
+	var form testForm
+	err := (&application{}).decodeForm(httptest.NewRecorder(), r, &form)
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		t.Errorf("got error %v; want a *http.MaxBytesError", err)
+	}
+}
+
+func TestDecodeValuesUnsupportedFieldType(t *testing.T) {
+	var form struct {
+		IDs []int `json:"ids"`
+		validator.Validator
+	}
+
+	// The field type is reported even when the field is not sent.
+	for _, values := range []url.Values{{"ids": {"1"}}, {}} {
+		err := decodeValues(values, &form)
+		if !errors.Is(err, errUnsupportedFieldType) {
+			t.Errorf("values %v: got error %v; want %v", values, err, errUnsupportedFieldType)
+		}
+	}
+}
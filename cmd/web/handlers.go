@@ -1,66 +1,186 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
+	"go.chat/internal/jwt"
 	"go.chat/internal/models"
+	"go.chat/internal/search"
 	"go.chat/internal/validator"
 )
 
+// The forms below are filled by decodeForm from JSON or form-encoded bodies,
+// using the json tags as field names in both.
+
 type userRegisterForm struct {
-	Email    string
-	Username string
-	Password string
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	Password string `json:"password"`
 	validator.Validator
 }
 
 type userLoginForm struct {
-	Email    string
-	Password string
+	Email    string `json:"email"`
+	Password string `json:"password"`
 	validator.Validator
 }
 
 type createChatForm struct {
-	Name       string
-	IsPrivate  bool
-	ReceiverID int
+	Name       string `json:"name"`
+	IsPrivate  bool   `json:"is_private"`
+	ReceiverID int    `json:"receiver_id"`
 	validator.Validator
 }
 
 type createMessageForm struct {
-	Content string
-	ChatID  int
+	Content string `json:"content"`
+	ChatID  int    `json:"chat_id"`
+	// ParentID is the message replied to, or 0 for a top-level message.
+	ParentID int `json:"parent_id"`
+	// Files are the attachments uploaded with a multipart request.
+	Files []*multipart.FileHeader `json:"-"`
+	validator.Validator
+}
+
+type editMessageForm struct {
+	MessageID int    `json:"message_id"`
+	Content   string `json:"content"`
+	validator.Validator
+}
+
+type deleteMessageForm struct {
+	MessageID int `json:"message_id"`
+	validator.Validator
+}
+
+type threadFollowForm struct {
+	MessageID int `json:"message_id"`
+	validator.Validator
+}
+
+type reactionForm struct {
+	MessageID int    `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	validator.Validator
+}
+
+// messagePageForm holds the cursor parameters of getMessages. Before and
+// After are message IDs; at most one of them may be set.
+type messagePageForm struct {
+	Before int
+	After  int
+	Limit  int
+	validator.Validator
+}
+
+// searchForm holds the parameters of searchMessages. From and To are whole
+// days, both included.
+type searchForm struct {
+	Query         string
+	ChatID        int
+	SenderID      int
+	From          *time.Time
+	To            *time.Time
+	HasAttachment bool
+	Offset        int
+	Limit         int
+	validator.Validator
+}
+
+type leaveChatForm struct {
+	ChatID int `json:"chat_id"`
+	validator.Validator
+}
+
+type removeMemberForm struct {
+	ChatID int `json:"chat_id"`
+	UserID int `json:"user_id"`
+	validator.Validator
+}
+
+type memberRoleForm struct {
+	ChatID int    `json:"chat_id"`
+	UserID int    `json:"user_id"`
+	Role   string `json:"role"`
+	validator.Validator
+}
+
+type transferOwnershipForm struct {
+	ChatID int `json:"chat_id"`
+	UserID int `json:"user_id"`
+	validator.Validator
+}
+
+// createInviteForm leaves ExpiresIn empty and MaxUses nil for invites that
+// never expire or have no use limit.
+type createInviteForm struct {
+	ChatID    int    `json:"chat_id"`
+	ExpiresIn string `json:"expires_in"`
+	MaxUses   *int   `json:"max_uses"`
+	validator.Validator
+}
+
+type revokeInviteForm struct {
+	InviteID int `json:"invite_id"`
+	validator.Validator
+}
+
+type acceptInviteForm struct {
+	Token string `json:"token"`
+	validator.Validator
+}
+
+type readForm struct {
+	ChatID    int `json:"chat_id"`
+	MessageID int `json:"message_id"`
+	validator.Validator
+}
+
+type presenceForm struct {
+	UserIDs []int
 	validator.Validator
 }
 
 type joinChatForm struct {
-	ChatID int
+	ChatID int `json:"chat_id"`
 	validator.Validator
 }
 
-var upgrader = websocket.Upgrader{}
+var (
+	errInvalidForm     = errors.New("invalid form")
+	errChatNotFound    = errors.New("chat not found")
+	errNotParticipant  = errors.New("user is not a participant in chat")
+	errMessageNotFound = errors.New("message not found")
+	errMuted           = errors.New("user is muted in chat")
+)
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{wsProtocol},
+}
 
 func (app *application) home(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Hello from goChat"))
 }
 
 func (app *application) userRegister(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+	var form userRegisterForm
+	err := app.decodeForm(w, r, &form)
 	if err != nil {
-		app.errorLog.Printf("Error parsing form in userRegister: %v", err)
-		app.clientError(w, http.StatusBadRequest)
+		app.errorLog.Printf("Error decoding body in userRegister: %v", err)
+		app.decodeError(w, err)
 		return
 	}
-	form := userRegisterForm{
-		Email:    r.PostForm.Get("email"),
-		Username: r.PostForm.Get("username"),
-		Password: r.PostForm.Get("password"),
-	}
 
 	form.CheckField(validator.NotBlank(form.Username), "username", "this field cannot be empty")
 	form.CheckField(validator.NotBlank(form.Email), "username", "this field cannot be empty")
@@ -86,14 +206,7 @@ func (app *application) userRegister(w http.ResponseWriter, r *http.Request) {
 		form.AddFieldError("username", "username already exists")
 	}
 	if !form.Valid() {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		err := json.NewEncoder(w).Encode(form.FieldErrors)
-		if err != nil {
-			app.errorLog.Printf("Error encoding form errors: %v", err)
-			app.serverError(w, err)
-			return
-		}
+		app.invalidForm(w, form.FieldErrors)
 		return
 	}
 
@@ -107,30 +220,20 @@ func (app *application) userRegister(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) userLogin(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+	var form userLoginForm
+	err := app.decodeForm(w, r, &form)
 	if err != nil {
-		app.errorLog.Printf("Error parsing form in userLogin: %v", err)
-		app.clientError(w, http.StatusBadRequest)
+		app.errorLog.Printf("Error decoding body in userLogin: %v", err)
+		app.decodeError(w, err)
 		return
 	}
-	form := userLoginForm{
-		Email:    r.PostForm.Get("email"),
-		Password: r.PostForm.Get("password"),
-	}
 
 	form.CheckField(validator.NotBlank(form.Email), "email", "this field cannot be empty")
 	form.CheckField(validator.NotBlank(form.Password), "password", "this field cannot be empty")
 	form.CheckField(validator.Matches(validator.EmailRX, form.Email), "email", "invalid email")
 
 	if !form.Valid() {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		err := json.NewEncoder(w).Encode(form.FieldErrors)
-		if err != nil {
-			app.errorLog.Printf("Error encoding form errors: %v", err)
-			app.serverError(w, err)
-			return
-		}
+		app.invalidForm(w, form.FieldErrors)
 		return
 	}
 
@@ -138,11 +241,7 @@ func (app *application) userLogin(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		if err == models.ErrInvalidCredentials {
 			app.errorLog.Printf("Invalid login attempt for email: %s", form.Email)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error": "Invalid email or password",
-			})
+			app.errorResponse(w, http.StatusUnauthorized, "invalid_credentials", "Invalid email or password", nil)
 			return
 		}
 		app.errorLog.Printf("Error during authentication: %v", err)
@@ -150,54 +249,38 @@ func (app *application) userLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := app.jwt.GenerateToken(id, form.Email)
+	access, refresh, err := app.startSession(w, id, form.Email)
 	if err != nil {
-		app.errorLog.Printf("Error generating JWT token: %v", err)
+		app.errorLog.Printf("Error starting session: %v", err)
 		app.serverError(w, err)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    token,
-		Path:     "/",
-		MaxAge:   24 * 60 * 60,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-	})
-
 	app.infoLog.Printf("User logged in successfully with ID: %d", id)
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]any{
-		"id": id,
+		"id":            id,
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int(app.jwt.TTL().Seconds()),
+		"refresh_token": refresh,
 	})
 }
 
 func (app *application) createChat(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+	var form createChatForm
+	err := app.decodeForm(w, r, &form)
 	if err != nil {
-		app.errorLog.Printf("Error parsing form in createChat: %v", err)
-		app.clientError(w, http.StatusBadRequest)
-		return
-	}
-
-	receiverID, err := strconv.Atoi(r.PostForm.Get("receiver_id"))
-	if err != nil {
-		app.errorLog.Printf("Error parsing receiver_id: %v", err)
-		app.clientError(w, http.StatusBadRequest)
+		app.errorLog.Printf("Error decoding body in createChat: %v", err)
+		app.decodeError(w, err)
 		return
 	}
 
-	form := createChatForm{
-		Name:       r.PostForm.Get("name"),
-		IsPrivate:  r.PostForm.Get("is_private") == "true",
-		ReceiverID: receiverID,
-	}
-
 	form.CheckField(validator.NotBlank(form.Name), "name", "this field cannot be empty")
 	form.CheckField(validator.MaxChars(form.Name, 50), "name", "this field cannot have more than 50 characters")
+	form.CheckField(!strings.HasPrefix(strings.ToLower(strings.TrimSpace(form.Name)), models.DirectNamePrefix), "name", "this field cannot start with "+models.DirectNamePrefix)
 
 	if form.IsPrivate {
 		form.CheckField(form.ReceiverID > 0, "receiver_id", "receiver ID is required for private chats")
@@ -213,14 +296,7 @@ func (app *application) createChat(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !form.Valid() {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		err := json.NewEncoder(w).Encode(form.FieldErrors)
-		if err != nil {
-			app.errorLog.Printf("Error encoding form errors: %v", err)
-			app.serverError(w, err)
-			return
-		}
+		app.invalidForm(w, form.FieldErrors)
 		return
 	}
 
@@ -232,9 +308,7 @@ func (app *application) createChat(w http.ResponseWriter, r *http.Request) {
 	}
 	if exists {
 		form.AddFieldError("name", "chat name already exists")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(form.FieldErrors)
+		app.invalidForm(w, form.FieldErrors)
 		return
 	}
 
@@ -246,7 +320,7 @@ func (app *application) createChat(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID := r.Context().Value("user_id").(int)
-	_, err = app.participants.Insert(id, userID)
+	_, err = app.participants.Insert(id, userID, models.RoleOwner)
 	if err != nil {
 		app.errorLog.Printf("Error adding creator as participant: %v", err)
 		app.serverError(w, err)
@@ -254,7 +328,7 @@ func (app *application) createChat(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if form.IsPrivate {
-		_, err = app.participants.Insert(id, form.ReceiverID)
+		_, err = app.participants.Insert(id, form.ReceiverID, models.RoleMember)
 		if err != nil {
 			app.errorLog.Printf("Error adding receiver as participant: %v", err)
 			app.serverError(w, err)
@@ -270,241 +344,1768 @@ func (app *application) createChat(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (app *application) sendMessage(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+func (app *application) openDirectChat(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	otherID, err := strconv.Atoi(params.ByName("user_id"))
 	if err != nil {
-		app.errorLog.Printf("Error parsing form in sendMessage: %v", err)
+		app.errorLog.Printf("Error parsing user_id: %v", err)
 		app.clientError(w, http.StatusBadRequest)
 		return
 	}
 
-	chatID, err := strconv.Atoi(r.PostForm.Get("chat_id"))
-	if err != nil {
-		app.errorLog.Printf("Error parsing chat_id: %v", err)
+	userID := r.Context().Value("user_id").(int)
+	if otherID == userID {
 		app.clientError(w, http.StatusBadRequest)
 		return
 	}
 
-	form := createMessageForm{
-		Content: r.PostForm.Get("content"),
-		ChatID:  chatID,
+	exists, err := app.users.ExistsId(otherID)
+	if err != nil {
+		app.errorLog.Printf("Error checking user existence: %v", err)
+		app.serverError(w, err)
+		return
+	}
+	if !exists {
+		app.clientError(w, http.StatusNotFound)
+		return
 	}
 
-	form.CheckField(validator.NotBlank(form.Content), "content", "this field cannot be empty")
-	form.CheckField(validator.MaxChars(form.Content, 500), "content", "this field cannot have more than 500 characters")
+	id, created, err := app.chats.GetOrCreateDirect(userID, otherID)
+	if err == models.ErrDirectNameTaken {
+		app.errorLog.Printf("Name of direct chat between users %d and %d is taken", userID, otherID)
+		app.errorResponse(w, http.StatusConflict, "direct_chat_unavailable", "The direct conversation cannot be created; its name is taken by another chat", nil)
+		return
+	}
+	if err != nil {
+		app.errorLog.Printf("Error opening direct chat between users %d and %d: %v", userID, otherID, err)
+		app.serverError(w, err)
+		return
+	}
 
-	if !form.Valid() {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		err := json.NewEncoder(w).Encode(form.FieldErrors)
+	status := http.StatusOK
+	if created {
+		app.hub.join <- membership{userID: userID, chatID: id}
+		app.hub.join <- membership{userID: otherID, chatID: id}
+		app.infoLog.Printf("Direct chat %d created between users %d and %d", id, userID, otherID)
+		status = http.StatusCreated
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id": id,
+	})
+}
+
+func (app *application) sendMessage(w http.ResponseWriter, r *http.Request) {
+	// Attachments are sent as multipart/form-data "file" parts, which are
+	// parsed here with a larger body limit than decodeForm's.
+	var form createMessageForm
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		r.Body = http.MaxBytesReader(w, r.Body, app.uploads.maxBody())
+		err := r.ParseMultipartForm(multipartMemory)
 		if err != nil {
-			app.errorLog.Printf("Error encoding form errors: %v", err)
-			app.serverError(w, err)
+			app.errorLog.Printf("Error parsing multipart body in sendMessage: %v", err)
+			app.decodeError(w, err)
 			return
 		}
-		return
+		defer r.MultipartForm.RemoveAll()
+
+		form.Files = r.MultipartForm.File["file"]
+		for name := range r.MultipartForm.File {
+			form.CheckField(name == "file", name, "this field is not allowed")
+		}
 	}
 
-	exists, err := app.chats.ExistsId(form.ChatID)
+	err := app.decodeForm(w, r, &form)
 	if err != nil {
-		app.errorLog.Printf("Error checking chat existence: %v", err)
-		app.serverError(w, err)
-		return
-	}
-	if !exists {
-		app.errorLog.Printf("Chat not found with ID: %d", form.ChatID)
-		app.clientError(w, http.StatusNotFound)
+		app.errorLog.Printf("Error decoding body in sendMessage: %v", err)
+		app.decodeError(w, err)
 		return
 	}
 
+	form.CheckField(form.ChatID > 0, "chat_id", "this field must be a chat ID")
+
 	userID := r.Context().Value("user_id").(int)
-	participants, err := app.participants.GetByChatID(form.ChatID)
+	result, err := app.submitMessage(&form, userID)
 	if err != nil {
-		app.errorLog.Printf("Error getting chat participants: %v", err)
-		app.serverError(w, err)
+		switch err {
+		case errInvalidForm:
+			app.invalidForm(w, form.FieldErrors)
+		default:
+			app.errorLog.Printf("User %d cannot post to chat %d: %v", userID, form.ChatID, err)
+			app.authorizeError(w, err)
+		}
 		return
 	}
 
-	isParticipant := false
-	for _, p := range participants {
-		if p.UserID == userID {
-			isParticipant = true
-			break
+	// Commands answer 200 unless they posted a message or answer later, and
+	// carry their name and any reply for the user.
+	resp := map[string]any{}
+	status := http.StatusOK
+	if result.message != nil {
+		resp["id"] = result.message.ID
+		status = http.StatusCreated
+	} else if result.pending {
+		status = http.StatusAccepted
+	}
+	if result.command != "" {
+		resp["command"] = result.command
+		resp["reply"] = result.reply
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// postMessage validates form, checks that the user takes part in the chat and
+// is not muted, stores the message with its attachments and broadcasts it to
+// the chat's subscribers. Replies are only pushed to the thread's followers.
+// When errInvalidForm is returned the details are in form.FieldErrors.
+func (app *application) postMessage(form *createMessageForm, userID int) (*models.Message, error) {
+	form.CheckField(validator.NotBlank(form.Content) || len(form.Files) > 0, "content", "this field cannot be empty")
+	form.CheckField(validator.MaxChars(form.Content, 500), "content", "this field cannot have more than 500 characters")
+	if !form.Valid() {
+		return nil, errInvalidForm
+	}
+
+	_, err := app.authorize(form.ChatID, userID, permPost)
+	if err != nil {
+		return nil, err
+	}
+	err = app.checkNotMuted(form.ChatID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Uploads are only read once the user is known to be allowed to post.
+	types, err := app.checkUploads(form)
+	if err != nil {
+		app.errorLog.Printf("Error reading uploads: %v", err)
+		return nil, err
+	}
+	if !form.Valid() {
+		return nil, errInvalidForm
+	}
+
+	var parent *models.Message
+	if form.ParentID > 0 {
+		parent, err = app.messages.Get(form.ParentID)
+		if err != nil && err != models.ErrNoRecord {
+			app.errorLog.Printf("Error getting message %d: %v", form.ParentID, err)
+			return nil, err
+		}
+		form.CheckField(parent != nil && parent.ChatID == form.ChatID && !parent.Deleted, "parent_id", "message not found")
+		form.CheckField(parent == nil || parent.ParentID == nil, "parent_id", "replies cannot have replies")
+		if !form.Valid() {
+			return nil, errInvalidForm
 		}
 	}
 
-	if !isParticipant {
-		app.errorLog.Printf("User %d is not a participant in chat %d", userID, form.ChatID)
-		app.clientError(w, http.StatusForbidden)
-		return
+	attachments, err := app.storeUploads(form.ChatID, form.Files, types)
+	if err != nil {
+		app.errorLog.Printf("Error storing uploads: %v", err)
+		return nil, err
+	}
+
+	if parent != nil {
+		return app.postReply(parent, userID, form.Content, attachments)
 	}
 
 	id, err := app.messages.Insert(form.ChatID, userID, form.Content)
 	if err != nil {
 		app.errorLog.Printf("Error inserting message: %v", err)
-		app.serverError(w, err)
-		return
+		app.deleteBlobs(attachmentKeys(attachments))
+		return nil, err
 	}
 
-	// Broadcast message to connected clients
-	message := Message{
-		Type:    "message",
-		Content: form.Content,
-		ChatID:  form.ChatID,
-		UserID:  userID,
+	err = app.saveAttachments(id, attachments)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := app.messages.Get(id)
+	if err != nil {
+		app.errorLog.Printf("Error getting message %d: %v", id, err)
+		return nil, err
 	}
+	message.Attachments = attachments
 
-	messageBytes, err := json.Marshal(message)
+	// Broadcast message to connected clients
+	messageBytes, err := json.Marshal(newMessageFrame(message))
 	if err != nil {
 		app.errorLog.Printf("Error marshaling message for broadcast: %v", err)
-		app.serverError(w, err)
-		return
+		return nil, err
 	}
 
 	app.hub.broadcast <- messageBytes
 
+	app.indexMessage(message)
+
 	app.infoLog.Printf("Message sent successfully with ID: %d in chat: %d", id, form.ChatID)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]any{
-		"id": id,
-	})
+	return message, nil
 }
 
-func (app *application) getMessages(w http.ResponseWriter, r *http.Request) {
-	params := httprouter.ParamsFromContext(r.Context())
-	chatID, err := strconv.Atoi(params.ByName("chat_id"))
+func (app *application) editMessage(w http.ResponseWriter, r *http.Request) {
+	var form editMessageForm
+	err := app.decodeForm(w, r, &form)
 	if err != nil {
-		app.errorLog.Printf("Error parsing chat_id: %v", err)
-		app.clientError(w, http.StatusBadRequest)
+		app.errorLog.Printf("Error decoding body in editMessage: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	form.CheckField(form.MessageID > 0, "message_id", "this field must be a message ID")
+	form.CheckField(validator.NotBlank(form.Content), "content", "this field cannot be empty")
+	form.CheckField(validator.MaxChars(form.Content, 500), "content", "this field cannot have more than 500 characters")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
 		return
 	}
-	exists, err := app.chats.ExistsId(chatID)
+
+	message, err := app.messages.Get(form.MessageID)
 	if err != nil {
-		app.errorLog.Printf("Error checking chat existence: %v", err)
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error getting message %d: %v", form.MessageID, err)
 		app.serverError(w, err)
 		return
 	}
-	if !exists {
-		app.errorLog.Printf("Chat not found with ID: %d", chatID)
+	if message.Deleted {
 		app.clientError(w, http.StatusNotFound)
 		return
 	}
 
 	userID := r.Context().Value("user_id").(int)
-	participants, err := app.participants.GetByChatID(chatID)
+	_, err = app.authorize(message.ChatID, userID, permPost)
 	if err != nil {
-		app.errorLog.Printf("Error getting chat participants: %v", err)
-		app.serverError(w, err)
+		app.errorLog.Printf("User %d cannot edit in chat %d: %v", userID, message.ChatID, err)
+		app.authorizeError(w, err)
 		return
 	}
 
-	isParticipant := false
-	for _, p := range participants {
-		if p.UserID == userID {
-			isParticipant = true
-			break
+	if message.IsSystem || message.SenderID != userID {
+		app.errorLog.Printf("User %d cannot edit message %d", userID, message.ID)
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+	if time.Since(message.Created) > app.editWindow {
+		app.errorLog.Printf("Edit window of message %d has passed", message.ID)
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	err = app.messages.Update(message.ID, form.Content)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
 		}
+		app.errorLog.Printf("Error updating message %d: %v", message.ID, err)
+		app.serverError(w, err)
+		return
 	}
 
-	if !isParticipant {
-		app.errorLog.Printf("User %d is not a participant in chat %d", userID, chatID)
-		app.clientError(w, http.StatusForbidden)
+	message, err = app.messages.Get(message.ID)
+	if err != nil {
+		app.errorLog.Printf("Error getting message %d: %v", form.MessageID, err)
+		app.serverError(w, err)
 		return
 	}
 
-	messages, err := app.messages.GetByChatID(chatID)
+	app.indexMessage(message)
+
+	// The frame replaces the message on clients, so it carries the
+	// attachments too.
+	err = app.attachments.Load([]*models.Message{message})
+	if err != nil {
+		app.errorLog.Printf("Error getting attachments: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	frame := newMessageFrame(message)
+	frame.Type = "message_edited"
+	messageBytes, err := json.Marshal(frame)
+	if err != nil {
+		app.errorLog.Printf("Error marshaling message for broadcast: %v", err)
+		app.serverError(w, err)
+		return
+	}
+	err = app.publishMessageEvent(message, messageBytes)
 	if err != nil {
-		app.errorLog.Printf("Error getting messages: %v", err)
 		app.serverError(w, err)
 		return
 	}
 
-	app.infoLog.Printf("Retrieved %d messages for chat: %d", len(messages), chatID)
+	app.infoLog.Printf("Message %d edited by user %d", message.ID, userID)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]any{
-		"messages": messages,
+		"id":        message.ID,
+		"edited_at": message.EditedAt,
 	})
 }
 
-func (app *application) joinChat(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+func (app *application) deleteMessage(w http.ResponseWriter, r *http.Request) {
+	var form deleteMessageForm
+	err := app.decodeForm(w, r, &form)
 	if err != nil {
-		app.errorLog.Printf("Error parsing form in joinChat: %v", err)
-		app.clientError(w, http.StatusBadRequest)
+		app.errorLog.Printf("Error decoding body in deleteMessage: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	form.CheckField(form.MessageID > 0, "message_id", "this field must be a message ID")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
 		return
 	}
 
-	chatID, err := strconv.Atoi(r.PostForm.Get("chat_id"))
+	message, err := app.messages.Get(form.MessageID)
 	if err != nil {
-		app.errorLog.Printf("Error parsing chat_id: %v", err)
-		app.clientError(w, http.StatusBadRequest)
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error getting message %d: %v", form.MessageID, err)
+		app.serverError(w, err)
 		return
 	}
-	form := joinChatForm{
-		ChatID: chatID,
+	if message.Deleted {
+		app.clientError(w, http.StatusNotFound)
+		return
 	}
 
-	form.CheckField(validator.NotBlank(strconv.Itoa(form.ChatID)), "chat_id", "this field cannot be empty")
+	// Authors can delete their own messages, admins anyone's.
+	userID := r.Context().Value("user_id").(int)
+	perm := permPost
+	if message.IsSystem || message.SenderID != userID {
+		perm = permDeleteAnyMessage
+	}
+	_, err = app.authorize(message.ChatID, userID, perm)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot delete message %d: %v", userID, message.ID, err)
+		app.authorizeError(w, err)
+		return
+	}
 
-	if !form.Valid() {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		err := json.NewEncoder(w).Encode(form.FieldErrors)
-		if err != nil {
-			app.errorLog.Printf("Error encoding form errors: %v", err)
-			app.serverError(w, err)
+	err = app.messages.Delete(message.ID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
 			return
 		}
+		app.errorLog.Printf("Error deleting message %d: %v", message.ID, err)
+		app.serverError(w, err)
 		return
 	}
-	private, err := app.chats.IsPrivate(chatID)
+
+	keys, err := app.attachments.DeleteByMessageID(message.ID)
 	if err != nil {
-		app.errorLog.Printf("Error checking if chat is private: %v", err)
-		app.serverError(w, err)
-		return
+		app.errorLog.Printf("Error deleting attachments of message %d: %v", message.ID, err)
 	}
-	if private {
-		app.errorLog.Printf("Attempt to join private chat %d", chatID)
-		app.clientError(w, http.StatusForbidden)
-		return
+	app.deleteBlobs(keys)
+
+	err = app.search.Remove(context.Background(), message.ID)
+	if err != nil {
+		app.errorLog.Printf("Error removing message %d from search index: %v", message.ID, err)
 	}
 
-	userID := r.Context().Value("user_id").(int)
-	_, err = app.participants.Insert(form.ChatID, userID)
+	messageBytes, err := json.Marshal(Message{
+		Type:    "message_deleted",
+		ID:      message.ID,
+		ChatID:  message.ChatID,
+		UserID:  message.SenderID,
+		Deleted: true,
+	})
+	if err != nil {
+		app.errorLog.Printf("Error marshaling message for broadcast: %v", err)
+		app.serverError(w, err)
+		return
+	}
+	err = app.publishMessageEvent(message, messageBytes)
 	if err != nil {
-		app.errorLog.Printf("Error adding user to chat: %v", err)
 		app.serverError(w, err)
 		return
 	}
 
-	app.infoLog.Printf("User %d joined chat %d successfully", userID, form.ChatID)
+	app.infoLog.Printf("Message %d deleted by user %d", message.ID, userID)
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]any{
-		"id": form.ChatID,
+		"id": message.ID,
 	})
 }
 
-func (app *application) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+func (app *application) getMessageHistory(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	messageID, err := strconv.Atoi(params.ByName("message_id"))
 	if err != nil {
-		log.Printf("error upgrading connection: %v", err)
+		app.errorLog.Printf("Error parsing message_id: %v", err)
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	message, err := app.messages.Get(messageID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error getting message %d: %v", messageID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	_, err = app.authorize(message.ChatID, userID, permRead)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot read chat %d: %v", userID, message.ChatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+
+	edits, err := app.messages.GetEdits(message.ID)
+	if err != nil {
+		app.errorLog.Printf("Error getting edits of message %d: %v", message.ID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"message": message,
+		"edits":   edits,
+	})
+}
+
+// postReply stores a reply to parent and makes its author follow the thread,
+// as well as the author of parent on the first reply. The reply goes to the
+// thread's followers, and a "thread_updated" frame with the new reply count to
+// the whole chat.
+func (app *application) postReply(parent *models.Message, userID int, content string, attachments []*models.Attachment) (*models.Message, error) {
+	id, err := app.messages.InsertReply(parent.ChatID, userID, parent.ID, content)
+	if err != nil {
+		app.errorLog.Printf("Error inserting reply: %v", err)
+		app.deleteBlobs(attachmentKeys(attachments))
+		return nil, err
+	}
+
+	err = app.saveAttachments(id, attachments)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := app.messages.Get(id)
+	if err != nil {
+		app.errorLog.Printf("Error getting message %d: %v", id, err)
+		return nil, err
+	}
+	message.Attachments = attachments
+
+	followers := []int{userID}
+	if !parent.IsSystem {
+		followers = append(followers, parent.SenderID)
+	}
+	for _, followerID := range followers {
+		err = app.threads.Follow(parent.ID, followerID)
+		if err != nil {
+			app.errorLog.Printf("Error following thread %d: %v", parent.ID, err)
+			return nil, err
+		}
+	}
+
+	followers, err = app.threads.GetUserIDs(parent.ID)
+	if err != nil {
+		app.errorLog.Printf("Error getting followers of thread %d: %v", parent.ID, err)
+		return nil, err
+	}
+
+	messageBytes, err := json.Marshal(newMessageFrame(message))
+	if err != nil {
+		app.errorLog.Printf("Error marshaling message for broadcast: %v", err)
+		return nil, err
+	}
+	app.hub.sendToChatUsers(parent.ChatID, followers, messageBytes)
+
+	err = app.messages.LoadReplyStats([]*models.Message{parent})
+	if err != nil {
+		app.errorLog.Printf("Error getting reply count of message %d: %v", parent.ID, err)
+		return nil, err
+	}
+	messageBytes, err = json.Marshal(Message{
+		Type:        "thread_updated",
+		ID:          parent.ID,
+		ChatID:      parent.ChatID,
+		UserID:      parent.SenderID,
+		ReplyCount:  parent.ReplyCount,
+		LastReplyAt: parent.LastReplyAt,
+	})
+	if err != nil {
+		app.errorLog.Printf("Error marshaling message for broadcast: %v", err)
+		return nil, err
+	}
+	app.hub.broadcast <- messageBytes
+
+	app.indexMessage(message)
+
+	app.infoLog.Printf("Reply sent successfully with ID: %d to message: %d", id, parent.ID)
+	return message, nil
+}
+
+func (app *application) getThread(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	messageID, err := strconv.Atoi(params.ByName("message_id"))
+	if err != nil {
+		app.errorLog.Printf("Error parsing message_id: %v", err)
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	parent, err := app.messages.Get(messageID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error getting message %d: %v", messageID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	_, err = app.authorize(parent.ChatID, userID, permRead)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot read chat %d: %v", userID, parent.ChatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+
+	form := newMessagePageForm(r)
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	page, err := pageMessages(form, func(cursor, limit int) ([]*models.Message, error) {
+		return app.messages.GetRepliesBefore(parent.ID, cursor, limit)
+	}, func(cursor, limit int) ([]*models.Message, error) {
+		return app.messages.GetRepliesAfter(parent.ID, cursor, limit)
+	})
+	if err != nil {
+		app.errorLog.Printf("Error getting replies: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.messages.LoadReplyStats([]*models.Message{parent})
+	if err != nil {
+		app.errorLog.Printf("Error getting reply count of message %d: %v", parent.ID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	thread := append([]*models.Message{parent}, page.messages...)
+	err = app.reactions.Load(thread, userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting reactions: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.attachments.Load(thread)
+	if err != nil {
+		app.errorLog.Printf("Error getting attachments: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"parent":   parent,
+		"messages": page.messages,
+		"prev":     page.prev,
+		"next":     page.next,
+	})
+}
+
+func (app *application) followThread(w http.ResponseWriter, r *http.Request) {
+	app.setThreadFollow(w, r, true)
+}
+
+func (app *application) unfollowThread(w http.ResponseWriter, r *http.Request) {
+	app.setThreadFollow(w, r, false)
+}
+
+func (app *application) setThreadFollow(w http.ResponseWriter, r *http.Request, follow bool) {
+	var form threadFollowForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in setThreadFollow: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	form.CheckField(form.MessageID > 0, "message_id", "this field must be a message ID")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	message, err := app.messages.Get(form.MessageID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error getting message %d: %v", form.MessageID, err)
+		app.serverError(w, err)
+		return
+	}
+	if message.ParentID != nil {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	_, err = app.authorize(message.ChatID, userID, permRead)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot read chat %d: %v", userID, message.ChatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+
+	if follow {
+		err = app.threads.Follow(message.ID, userID)
+	} else {
+		err = app.threads.Unfollow(message.ID, userID)
+	}
+	if err != nil {
+		app.errorLog.Printf("Error updating follow of thread %d: %v", message.ID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":        message.ID,
+		"following": follow,
+	})
+}
+
+func (app *application) addReaction(w http.ResponseWriter, r *http.Request) {
+	app.setReaction(w, r, true)
+}
+
+func (app *application) removeReaction(w http.ResponseWriter, r *http.Request) {
+	app.setReaction(w, r, false)
+}
+
+// setReaction adds or removes the caller's emoji reaction to a message and
+// broadcasts the new count to the chat.
+func (app *application) setReaction(w http.ResponseWriter, r *http.Request, add bool) {
+	var form reactionForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in setReaction: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	form.CheckField(form.MessageID > 0, "message_id", "this field must be a message ID")
+	form.CheckField(validator.IsEmoji(form.Emoji, 16), "emoji", "this field must be a single emoji")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	message, err := app.messages.Get(form.MessageID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error getting message %d: %v", form.MessageID, err)
+		app.serverError(w, err)
+		return
+	}
+	if message.Deleted {
+		app.clientError(w, http.StatusNotFound)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	_, err = app.authorize(message.ChatID, userID, permPost)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot react in chat %d: %v", userID, message.ChatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+
+	var changed bool
+	typ := "reaction_added"
+	if add {
+		changed, err = app.reactions.Add(message.ID, userID, form.Emoji)
+	} else {
+		changed, err = app.reactions.Remove(message.ID, userID, form.Emoji)
+		typ = "reaction_removed"
+	}
+	if err != nil {
+		app.errorLog.Printf("Error updating reaction to message %d: %v", message.ID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	count, err := app.reactions.Count(message.ID, form.Emoji)
+	if err != nil {
+		app.errorLog.Printf("Error counting reactions to message %d: %v", message.ID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	if changed {
+		messageBytes, err := json.Marshal(Message{
+			Type:   typ,
+			ID:     message.ID,
+			ChatID: message.ChatID,
+			UserID: userID,
+			Emoji:  form.Emoji,
+			Count:  &count,
+		})
+		if err != nil {
+			app.errorLog.Printf("Error marshaling reaction for broadcast: %v", err)
+			app.serverError(w, err)
+			return
+		}
+		err = app.publishMessageEvent(message, messageBytes)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":      message.ID,
+		"emoji":   form.Emoji,
+		"count":   count,
+		"reacted": add,
+	})
+}
+
+func (app *application) getMessages(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	chatID, err := strconv.Atoi(params.ByName("chat_id"))
+	if err != nil {
+		app.errorLog.Printf("Error parsing chat_id: %v", err)
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	userID := r.Context().Value("user_id").(int)
+	_, err = app.authorize(chatID, userID, permRead)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot read chat %d: %v", userID, chatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+
+	form := newMessagePageForm(r)
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	page, err := pageMessages(form,
+		func(cursor, limit int) ([]*models.Message, error) {
+			return app.messages.GetBefore(chatID, cursor, limit)
+		},
+		func(cursor, limit int) ([]*models.Message, error) {
+			return app.messages.GetAfter(chatID, cursor, limit)
+		})
+	if err != nil {
+		app.errorLog.Printf("Error getting messages: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.messages.LoadReplyStats(page.messages)
+	if err != nil {
+		app.errorLog.Printf("Error getting reply counts: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.reactions.Load(page.messages, userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting reactions: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.attachments.Load(page.messages)
+	if err != nil {
+		app.errorLog.Printf("Error getting attachments: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	app.infoLog.Printf("Retrieved %d messages for chat: %d", len(page.messages), chatID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"messages": page.messages,
+		"prev":     page.prev,
+		"next":     page.next,
+	})
+}
+
+func (app *application) joinChat(w http.ResponseWriter, r *http.Request) {
+	var form joinChatForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in joinChat: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	form.CheckField(form.ChatID > 0, "chat_id", "this field must be a chat ID")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+	private, err := app.chats.IsPrivate(form.ChatID)
+	if err != nil {
+		app.errorLog.Printf("Error checking if chat is private: %v", err)
+		app.serverError(w, err)
+		return
+	}
+	if private {
+		app.errorLog.Printf("Attempt to join private chat %d", form.ChatID)
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	exists, err := app.participants.Exists(form.ChatID, userID)
+	if err != nil {
+		app.errorLog.Printf("Error checking participant: %v", err)
+		app.serverError(w, err)
+		return
+	}
+	if exists {
+		app.clientError(w, http.StatusConflict)
+		return
+	}
+
+	_, err = app.participants.Insert(form.ChatID, userID, models.RoleMember)
+	if err != nil {
+		app.errorLog.Printf("Error adding user to chat: %v", err)
+		app.serverError(w, err)
+		return
+	}
+	app.hub.join <- membership{userID: userID, chatID: form.ChatID}
+
+	app.infoLog.Printf("User %d joined chat %d successfully", userID, form.ChatID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id": form.ChatID,
+	})
+}
+
+func (app *application) markChatRead(w http.ResponseWriter, r *http.Request) {
+	var form readForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in markChatRead: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	advanced, err := app.markRead(&form, userID)
+	if err != nil {
+		switch err {
+		case errInvalidForm:
+			app.invalidForm(w, form.FieldErrors)
+		case errMessageNotFound:
+			app.clientError(w, http.StatusNotFound)
+		default:
+			app.errorLog.Printf("User %d cannot mark chat %d read: %v", userID, form.ChatID, err)
+			app.authorizeError(w, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"chat_id":    form.ChatID,
+		"message_id": form.MessageID,
+		"advanced":   advanced,
+	})
+}
+
+// markRead moves the user's read marker in the chat forward to the message
+// in form and broadcasts a "read" receipt to the chat. The marker never moves
+// backwards; advanced reports whether it moved. It is shared by markChatRead
+// and the WebSocket "read" frame.
+func (app *application) markRead(form *readForm, userID int) (advanced bool, err error) {
+	form.CheckField(form.MessageID > 0, "message_id", "this field must be a message ID")
+
+	if !form.Valid() {
+		return false, errInvalidForm
+	}
+
+	_, err = app.authorize(form.ChatID, userID, permRead)
+	if err != nil {
+		return false, err
+	}
+
+	message, err := app.messages.Get(form.MessageID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			return false, errMessageNotFound
+		}
+		app.errorLog.Printf("Error getting message %d: %v", form.MessageID, err)
+		return false, err
+	}
+	if message.ChatID != form.ChatID {
+		return false, errMessageNotFound
+	}
+
+	advanced, err = app.participants.UpdateLastRead(form.ChatID, userID, form.MessageID)
+	if err != nil {
+		app.errorLog.Printf("Error updating last read message: %v", err)
+		return false, err
+	}
+	if !advanced {
+		return false, nil
+	}
+
+	messageBytes, err := json.Marshal(Message{
+		Type:   "read",
+		ID:     form.MessageID,
+		ChatID: form.ChatID,
+		UserID: userID,
+	})
+	if err != nil {
+		app.errorLog.Printf("Error marshaling read receipt: %v", err)
+		return true, err
+	}
+	app.hub.broadcast <- messageBytes
+	return true, nil
+}
+
+func (app *application) listChats(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	chats, err := app.chats.GetByUserID(userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting chats for user %d: %v", userID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	for _, c := range chats {
+		if c.LastMessage != nil {
+			snippet := truncate(*c.LastMessage, 100)
+			c.LastMessage = &snippet
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"chats": chats,
+	})
+}
+
+// indexMessage adds a new or edited message to the search index. Failures
+// are only logged; the message is stored either way.
+func (app *application) indexMessage(message *models.Message) {
+	err := app.search.Index(context.Background(), message)
+	if err != nil {
+		app.errorLog.Printf("Error indexing message %d: %v", message.ID, err)
+	}
+}
+
+// searchMessages searches the messages of the chats the user takes part in,
+// or of a single chat with chat_id. A has:attachment word in q only matches
+// messages with attachments.
+func (app *application) searchMessages(w http.ResponseWriter, r *http.Request) {
+	form := newSearchForm(r)
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	var chatIDs []int
+	if form.ChatID > 0 {
+		_, err := app.authorize(form.ChatID, userID, permRead)
+		if err != nil {
+			app.errorLog.Printf("User %d cannot read chat %d: %v", userID, form.ChatID, err)
+			app.authorizeError(w, err)
+			return
+		}
+		chatIDs = []int{form.ChatID}
+	} else {
+		participants, err := app.participants.GetByUserID(userID)
+		if err != nil {
+			app.errorLog.Printf("Error getting chats of user %d: %v", userID, err)
+			app.serverError(w, err)
+			return
+		}
+		for _, p := range participants {
+			chatIDs = append(chatIDs, p.ChatID)
+		}
+	}
+
+	results, err := app.search.Search(r.Context(), search.Query{
+		Text:          form.Query,
+		ChatIDs:       chatIDs,
+		SenderID:      form.SenderID,
+		From:          form.From,
+		To:            form.To,
+		HasAttachment: form.HasAttachment,
+		Offset:        form.Offset,
+		Limit:         form.Limit,
+	})
+	if err != nil {
+		app.errorLog.Printf("Error searching messages: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"results": results.Hits,
+		"next":    results.Next,
+	})
+}
+
+func (app *application) getUnreadCounts(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	counts, err := app.messages.CountUnread(userID)
+	if err != nil {
+		app.errorLog.Printf("Error counting unread messages: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"chats": counts,
+	})
+}
+
+func (app *application) getPresence(w http.ResponseWriter, r *http.Request) {
+	var form presenceForm
+	for _, field := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			form.AddFieldError("ids", "this field must be a comma separated list of user IDs")
+			break
+		}
+		form.UserIDs = append(form.UserIDs, id)
+	}
+
+	form.CheckField(len(form.UserIDs) > 0, "ids", "this field cannot be empty")
+	form.CheckField(len(form.UserIDs) <= 100, "ids", "this field cannot have more than 100 user IDs")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	lastSeen, err := app.users.GetLastSeen(form.UserIDs)
+	if err != nil {
+		app.errorLog.Printf("Error getting last seen: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	presence := make([]map[string]any, 0, len(form.UserIDs))
+	for _, id := range form.UserIDs {
+		p := map[string]any{
+			"user_id":   id,
+			"status":    app.hub.status(id),
+			"last_seen": nil,
+		}
+		if t, ok := lastSeen[id]; ok {
+			p["last_seen"] = t
+		}
+		presence = append(presence, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"presence": presence,
+	})
+}
+
+func (app *application) leaveChat(w http.ResponseWriter, r *http.Request) {
+	var form leaveChatForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in leaveChat: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	form.CheckField(form.ChatID > 0, "chat_id", "this field must be a chat ID")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	role, err := app.authorize(form.ChatID, userID, permRead)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot leave chat %d: %v", userID, form.ChatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+	if !app.checkNotDirect(w, form.ChatID) {
+		return
+	}
+
+	// The owner has to hand the chat over before leaving, unless nobody else
+	// is left in it.
+	if role == models.RoleOwner {
+		participants, err := app.participants.GetByChatID(form.ChatID)
+		if err != nil {
+			app.errorLog.Printf("Error getting chat participants: %v", err)
+			app.serverError(w, err)
+			return
+		}
+		if len(participants) > 1 {
+			form.AddFieldError("chat_id", "transfer ownership before leaving this chat")
+			app.errorResponse(w, http.StatusConflict, "ownership_required", "Transfer ownership before leaving this chat", form.FieldErrors)
+			return
+		}
+	}
+
+	user, err := app.users.Get(userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting user %d: %v", userID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.removeParticipant(form.ChatID, userID, user.Username+" left")
+	if err != nil {
+		app.authorizeError(w, err)
+		return
+	}
+
+	app.infoLog.Printf("User %d left chat %d", userID, form.ChatID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id": form.ChatID,
+	})
+}
+
+func (app *application) removeMember(w http.ResponseWriter, r *http.Request) {
+	var form removeMemberForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in removeMember: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	form.CheckField(form.ChatID > 0, "chat_id", "this field must be a chat ID")
+	form.CheckField(form.UserID > 0, "user_id", "this field must be a user ID")
+	form.CheckField(form.UserID != userID, "user_id", "use /chat/leave to leave a chat")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	role, err := app.authorize(form.ChatID, userID, permManageMembers)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot remove members of chat %d: %v", userID, form.ChatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+	if !app.checkNotDirect(w, form.ChatID) {
+		return
+	}
+
+	memberRole, err := app.participants.GetRole(form.ChatID, form.UserID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error getting role of user %d in chat %d: %v", form.UserID, form.ChatID, err)
+		app.serverError(w, err)
+		return
+	}
+	if roleRank(memberRole) >= roleRank(role) {
+		app.errorLog.Printf("User %d cannot remove user %d with role %s", userID, form.UserID, memberRole)
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	admin, err := app.users.Get(userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting user %d: %v", userID, err)
+		app.serverError(w, err)
+		return
+	}
+	member, err := app.users.Get(form.UserID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error getting user %d: %v", form.UserID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.removeParticipant(form.ChatID, form.UserID, admin.Username+" removed "+member.Username)
+	if err != nil {
+		if err == errNotParticipant {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	app.infoLog.Printf("User %d removed user %d from chat %d", userID, form.UserID, form.ChatID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":      form.ChatID,
+		"user_id": form.UserID,
+	})
+}
+
+func (app *application) setMemberRole(w http.ResponseWriter, r *http.Request) {
+	var form memberRoleForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in setMemberRole: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	form.CheckField(form.ChatID > 0, "chat_id", "this field must be a chat ID")
+	form.CheckField(form.UserID > 0, "user_id", "this field must be a user ID")
+	form.CheckField(form.Role == models.RoleAdmin || form.Role == models.RoleMember, "role", "role must be admin or member")
+	form.CheckField(form.UserID != userID, "user_id", "you cannot change your own role")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	_, err = app.authorize(form.ChatID, userID, permManageRoles)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot change roles in chat %d: %v", userID, form.ChatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+
+	err = app.participants.UpdateRole(form.ChatID, form.UserID, form.Role)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error updating role of user %d in chat %d: %v", form.UserID, form.ChatID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	member, err := app.users.Get(form.UserID)
+	if err != nil {
+		app.errorLog.Printf("Error getting user %d: %v", form.UserID, err)
+		app.serverError(w, err)
+		return
+	}
+	err = app.postSystemMessage(form.ChatID, form.UserID, member.Username+" is now "+form.Role)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.infoLog.Printf("User %d set role of user %d in chat %d to %s", userID, form.UserID, form.ChatID, form.Role)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":      form.ChatID,
+		"user_id": form.UserID,
+		"role":    form.Role,
+	})
+}
+
+func (app *application) transferOwnership(w http.ResponseWriter, r *http.Request) {
+	var form transferOwnershipForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in transferOwnership: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	form.CheckField(form.ChatID > 0, "chat_id", "this field must be a chat ID")
+	form.CheckField(form.UserID > 0, "user_id", "this field must be a user ID")
+	form.CheckField(form.UserID != userID, "user_id", "you already own this chat")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	_, err = app.authorize(form.ChatID, userID, permTransferOwnership)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot transfer chat %d: %v", userID, form.ChatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+
+	err = app.participants.TransferOwnership(form.ChatID, userID, form.UserID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error transferring chat %d to user %d: %v", form.ChatID, form.UserID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	owner, err := app.users.Get(form.UserID)
+	if err != nil {
+		app.errorLog.Printf("Error getting user %d: %v", form.UserID, err)
+		app.serverError(w, err)
+		return
+	}
+	err = app.postSystemMessage(form.ChatID, form.UserID, owner.Username+" is now the owner")
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.infoLog.Printf("User %d transferred chat %d to user %d", userID, form.ChatID, form.UserID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":      form.ChatID,
+		"user_id": form.UserID,
+	})
+}
+
+func (app *application) createInvite(w http.ResponseWriter, r *http.Request) {
+	var form createInviteForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in createInvite: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	form.CheckField(form.ChatID > 0, "chat_id", "this field must be a chat ID")
+	var expiresIn time.Duration
+	if form.ExpiresIn != "" {
+		expiresIn, err = time.ParseDuration(form.ExpiresIn)
+		form.CheckField(err == nil && expiresIn > 0, "expires_in", "this field must be a positive duration such as 24h")
+	}
+	form.CheckField(form.MaxUses == nil || *form.MaxUses > 0, "max_uses", "this field must be a positive integer")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	_, err = app.authorize(form.ChatID, userID, permManageMembers)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot invite to chat %d: %v", userID, form.ChatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+
+	var expires *time.Time
+	if expiresIn > 0 {
+		t := time.Now().UTC().Add(expiresIn).Truncate(time.Second)
+		expires = &t
+	}
+
+	id, err := app.invites.Insert(form.ChatID, userID, expires, form.MaxUses)
+	if err != nil {
+		app.errorLog.Printf("Error inserting invite: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	invite, err := app.invites.Get(id)
+	if err != nil {
+		app.errorLog.Printf("Error getting invite %d: %v", id, err)
+		app.serverError(w, err)
+		return
+	}
+
+	resp, err := app.inviteResponse(invite)
+	if err != nil {
+		app.errorLog.Printf("Error generating invite token: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	app.infoLog.Printf("User %d created invite %d for chat %d", userID, id, form.ChatID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (app *application) listInvites(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	chatID, err := strconv.Atoi(params.ByName("chat_id"))
+	if err != nil {
+		app.errorLog.Printf("Error parsing chat_id: %v", err)
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	_, err = app.authorize(chatID, userID, permManageMembers)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot list invites of chat %d: %v", userID, chatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+
+	invites, err := app.invites.GetActiveByChatID(chatID)
+	if err != nil {
+		app.errorLog.Printf("Error getting invites: %v", err)
+		app.serverError(w, err)
+		return
+	}
+
+	resp := make([]map[string]any, 0, len(invites))
+	for _, invite := range invites {
+		inv, err := app.inviteResponse(invite)
+		if err != nil {
+			app.errorLog.Printf("Error generating invite token: %v", err)
+			app.serverError(w, err)
+			return
+		}
+		resp = append(resp, inv)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"invites": resp,
+	})
+}
+
+func (app *application) revokeInvite(w http.ResponseWriter, r *http.Request) {
+	var form revokeInviteForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in revokeInvite: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	form.CheckField(form.InviteID > 0, "invite_id", "this field must be an invite ID")
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	invite, err := app.invites.Get(form.InviteID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.errorLog.Printf("Error getting invite %d: %v", form.InviteID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	_, err = app.authorize(invite.ChatID, userID, permManageMembers)
+	if err != nil {
+		app.errorLog.Printf("User %d cannot revoke invites of chat %d: %v", userID, invite.ChatID, err)
+		app.authorizeError(w, err)
+		return
+	}
+
+	err = app.invites.Revoke(form.InviteID)
+	if err != nil {
+		app.errorLog.Printf("Error revoking invite %d: %v", form.InviteID, err)
+		app.serverError(w, err)
+		return
+	}
+
+	app.infoLog.Printf("User %d revoked invite %d", userID, form.InviteID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id": form.InviteID,
+	})
+}
+
+func (app *application) acceptInvite(w http.ResponseWriter, r *http.Request) {
+	var form acceptInviteForm
+	err := app.decodeForm(w, r, &form)
+	if err != nil {
+		app.errorLog.Printf("Error decoding body in acceptInvite: %v", err)
+		app.decodeError(w, err)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Token), "token", "this field cannot be empty")
+
+	var claims *jwt.InviteClaims
+	if form.Valid() {
+		claims, err = app.jwt.ValidateInviteToken(form.Token)
+		switch err {
+		case nil:
+		case jwt.ErrExpiredToken:
+			form.AddFieldError("token", "this invite has expired")
+		default:
+			form.AddFieldError("token", "invalid invite")
+		}
+	}
+
+	if !form.Valid() {
+		app.invalidForm(w, form.FieldErrors)
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+	chatID, err := app.invites.Accept(claims.InviteID, userID)
+	if err != nil {
+		switch err {
+		case models.ErrNoRecord, models.ErrInviteUnusable:
+			app.errorLog.Printf("Unusable invite %d: %v", claims.InviteID, err)
+			app.clientError(w, http.StatusGone)
+		case models.ErrAlreadyParticipant:
+			app.clientError(w, http.StatusConflict)
+		default:
+			app.errorLog.Printf("Error accepting invite %d: %v", claims.InviteID, err)
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.hub.join <- membership{userID: userID, chatID: chatID}
+
+	user, err := app.users.Get(userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting user %d: %v", userID, err)
+		app.serverError(w, err)
+		return
+	}
+	err = app.postSystemMessage(chatID, userID, user.Username+" joined")
+	if err != nil {
+		app.serverError(w, err)
 		return
 	}
 
+	app.infoLog.Printf("User %d joined chat %d with invite %d", userID, chatID, claims.InviteID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"id": chatID,
+	})
+}
+
+// inviteResponse describes an invite together with a token for it.
+func (app *application) inviteResponse(invite *models.Invite) (map[string]any, error) {
+	token, err := app.jwt.GenerateInviteToken(invite.ID, invite.ChatID, invite.Expires)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"id":       invite.ID,
+		"chat_id":  invite.ChatID,
+		"token":    token,
+		"expires":  invite.Expires,
+		"max_uses": invite.MaxUses,
+		"uses":     invite.Uses,
+	}, nil
+}
+
+// publishMessageEvent pushes an event about the message to the chat, or only
+// to the thread's followers if the message is a reply, as postReply does for
+// new replies.
+func (app *application) publishMessageEvent(message *models.Message, messageBytes []byte) error {
+	if message.ParentID == nil {
+		app.hub.broadcast <- messageBytes
+		return nil
+	}
+
+	followers, err := app.threads.GetUserIDs(*message.ParentID)
+	if err != nil {
+		app.errorLog.Printf("Error getting followers of thread %d: %v", *message.ParentID, err)
+		return err
+	}
+	app.hub.sendToChatUsers(message.ChatID, followers, messageBytes)
+	return nil
+}
+
+// checkNotDirect answers 409 and returns false if the chat is a direct
+// conversation, whose two members cannot change.
+func (app *application) checkNotDirect(w http.ResponseWriter, chatID int) bool {
+	direct, err := app.chats.IsDirect(chatID)
+	if err != nil {
+		app.errorLog.Printf("Error checking if chat %d is direct: %v", chatID, err)
+		app.serverError(w, err)
+		return false
+	}
+	if direct {
+		app.errorResponse(w, http.StatusConflict, "direct_chat", "The members of a direct conversation cannot change", nil)
+		return false
+	}
+	return true
+}
+
+// removeParticipant takes the user out of the chat, drops the chat from the
+// user's live connections and posts content as a system message to the
+// remaining members.
+func (app *application) removeParticipant(chatID, userID int, content string) error {
+	err := app.participants.Delete(chatID, userID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			return errNotParticipant
+		}
+		app.errorLog.Printf("Error removing user %d from chat %d: %v", userID, chatID, err)
+		return err
+	}
+
+	app.hub.leave <- membership{userID: userID, chatID: chatID}
+	return app.postSystemMessage(chatID, userID, content)
+}
+
+// postSystemMessage stores content as a system message about the user and
+// broadcasts it to the chat.
+func (app *application) postSystemMessage(chatID, userID int, content string) error {
+	id, err := app.messages.InsertSystem(chatID, userID, content)
+	if err != nil {
+		app.errorLog.Printf("Error inserting system message: %v", err)
+		return err
+	}
+
+	message, err := app.messages.Get(id)
+	if err != nil {
+		app.errorLog.Printf("Error getting message %d: %v", id, err)
+		return err
+	}
+
+	messageBytes, err := json.Marshal(newMessageFrame(message))
+	if err != nil {
+		app.errorLog.Printf("Error marshaling message for broadcast: %v", err)
+		return err
+	}
+	app.hub.broadcast <- messageBytes
+	return nil
+}
+
+func (app *application) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(int)
+	sessionID, _ := r.Context().Value("session_id").(int)
+	apiTokenID, _ := r.Context().Value("api_token_id").(int)
+	scopes, _ := r.Context().Value("api_token_scopes").([]string)
+
+	lastSeen, err := parseResume(r.URL.Query().Get("resume"))
+	if err != nil {
+		app.errorLog.Printf("Error parsing resume: %v", err)
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	participants, err := app.participants.GetByUserID(userID)
+	if err != nil {
+		app.errorLog.Printf("Error getting chats for user %d: %v", userID, err)
+		app.serverError(w, err)
+		return
+	}
+	// Without a resume parameter the client may resume with its first frame
+	// instead, so its live frames are held until then.
+	holding := !r.URL.Query().Has("resume")
 
+	upgrader := upgrader
+	upgrader.Error = func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		app.clientError(w, status)
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("error upgrading connection: %v", err)
+		return
+	}
 
 	client := &Client{
-		hub:    app.hub,
-		conn:   conn,
-		send:   make(chan []byte, 256),
-		userID: userID,
+		app:        app,
+		hub:        app.hub,
+		conn:       conn,
+		send:       make(chan []byte, 256),
+		userID:     userID,
+		sessionID:  sessionID,
+		apiTokenID: apiTokenID,
+		scopes:     scopes,
+		chats:      make(map[int]bool),
+		pending:    make(map[int][]heldFrame),
+		holding:    holding,
+	}
+	for _, p := range participants {
+		client.chats[p.ChatID] = true
+		if holding {
+			client.pending[p.ChatID] = nil
+		}
+	}
+	// Live frames for resumed chats are held until the missed messages have
+	// been replayed, so the client sees them in order.
+	for chatID := range lastSeen {
+		if !client.chats[chatID] {
+			delete(lastSeen, chatID)
+			continue
+		}
+		client.pending[chatID] = nil
 	}
 
 	client.hub.register <- client
+	if holding {
+		time.AfterFunc(resumeWait, func() { client.release(nil) })
+	} else {
+		go client.resume(lastSeen)
+	}
 
 	go client.writePump()
 	go client.readPump()
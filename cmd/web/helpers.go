@@ -1,21 +1,230 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.chat/internal/models"
+	"go.chat/internal/search"
+	"go.chat/internal/validator"
 )
 
+// apiError is the body of every error response, wrapped in an "error"
+// object. Fields holds the per-field messages of validation failures, and
+// RequestID the ID set by the requestID middleware, for matching the
+// response with the server logs.
+type apiError struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
+// errorResponse writes an error response in the standard envelope.
+func (app *application) errorResponse(w http.ResponseWriter, status int, code, message string, fields map[string]string) {
+	body := map[string]apiError{
+		"error": {
+			Code:      code,
+			Message:   message,
+			Fields:    fields,
+			RequestID: w.Header().Get(requestIDHeader),
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		app.errorLog.Printf("Error encoding error response: %v", err)
+	}
+}
+
 func (app *application) serverError(w http.ResponseWriter, err error) {
 	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
 	app.errorLog.Output(2, trace)
-	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	app.clientError(w, http.StatusInternalServerError)
 }
 
+// clientError writes an error response whose code and message are derived
+// from status, such as "not_found" and "Not Found".
 func (app *application) clientError(w http.ResponseWriter, status int) {
-	http.Error(w, http.StatusText(status), status)
+	text := http.StatusText(status)
+	code := strings.ToLower(strings.ReplaceAll(text, " ", "_"))
+	app.errorResponse(w, status, code, text, nil)
 }
 
 func (app *application) notFound(w http.ResponseWriter) {
-	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	app.clientError(w, http.StatusNotFound)
+}
+
+// invalidForm writes the response for a form that failed validation.
+func (app *application) invalidForm(w http.ResponseWriter, fieldErrors map[string]string) {
+	app.errorResponse(w, http.StatusBadRequest, "invalid_form", "One or more fields are invalid", fieldErrors)
+}
+
+// parseResume parses the resume parameter of the WebSocket endpoint, a comma
+// separated list of chat_id:last_message_id pairs.
+func parseResume(s string) (map[int]int, error) {
+	lastSeen := make(map[int]int)
+	if s == "" {
+		return lastSeen, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		chat, last, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid resume pair %q", pair)
+		}
+		chatID, err := strconv.Atoi(chat)
+		if err != nil {
+			return nil, err
+		}
+		lastID, err := strconv.Atoi(last)
+		if err != nil {
+			return nil, err
+		}
+		lastSeen[chatID] = lastID
+	}
+	return lastSeen, nil
+}
+
+// truncate shortens s to at most n runes, ending it with an ellipsis when
+// anything was cut.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// newMessagePageForm reads the before, after and limit query parameters of a
+// message listing. Callers must check form.Valid().
+func newMessagePageForm(r *http.Request) messagePageForm {
+	query := r.URL.Query()
+	form := messagePageForm{Limit: 50}
+	for key, dst := range map[string]*int{"before": &form.Before, "after": &form.After, "limit": &form.Limit} {
+		if v := query.Get(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				form.AddFieldError(key, "this field must be an integer")
+				continue
+			}
+			*dst = n
+		}
+	}
+
+	form.CheckField(form.Before >= 0, "before", "this field cannot be negative")
+	form.CheckField(form.After >= 0, "after", "this field cannot be negative")
+	form.CheckField(form.Before == 0 || form.After == 0, "before", "before and after cannot be used together")
+	form.CheckField(form.Limit > 0 && form.Limit <= 100, "limit", "this field must be between 1 and 100")
+	return form
+}
+
+// newSearchForm reads and validates the query parameters of searchMessages.
+// Callers must check form.Valid().
+func newSearchForm(r *http.Request) searchForm {
+	query := r.URL.Query()
+	form := searchForm{Limit: 20}
+
+	var words []string
+	for _, word := range strings.Fields(query.Get("q")) {
+		if strings.EqualFold(word, "has:attachment") {
+			form.HasAttachment = true
+			continue
+		}
+		words = append(words, word)
+	}
+	form.Query = strings.Join(words, " ")
+
+	for key, dst := range map[string]*int{"chat_id": &form.ChatID, "sender_id": &form.SenderID, "offset": &form.Offset, "limit": &form.Limit} {
+		if v := query.Get(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				form.AddFieldError(key, "this field must be an integer")
+				continue
+			}
+			*dst = n
+		}
+	}
+
+	for key, dst := range map[string]**time.Time{"from": &form.From, "to": &form.To} {
+		if v := query.Get(key); v != "" {
+			t, err := time.Parse(time.DateOnly, v)
+			if err != nil {
+				form.AddFieldError(key, "this field must be a date (YYYY-MM-DD)")
+				continue
+			}
+			*dst = &t
+		}
+	}
+	if form.To != nil {
+		// To is inclusive for the caller but exclusive for the engine.
+		to := form.To.AddDate(0, 0, 1)
+		form.To = &to
+	}
+
+	form.CheckField(validator.MaxChars(form.Query, 200), "q", "this field cannot have more than 200 characters")
+	filtered := form.ChatID > 0 || form.SenderID > 0 || form.From != nil || form.To != nil || form.HasAttachment
+	form.CheckField(filtered || len(search.Terms(form.Query)) > 0, "q", "this field must contain a word to search for unless a filter is given")
+	form.CheckField(form.Offset >= 0, "offset", "this field cannot be negative")
+	form.CheckField(form.Limit > 0 && form.Limit <= 50, "limit", "this field must be between 1 and 50")
+	form.CheckField(form.From == nil || form.To == nil || form.From.Before(*form.To), "from", "this field cannot be after to")
+	return form
+}
+
+// messagePage is one page of a message listing. prev and next are the
+// cursors to pass as before and after to walk to the neighbouring pages; they
+// are nil when there is nothing more in that direction.
+type messagePage struct {
+	messages []*models.Message
+	prev     *int
+	next     *int
+}
+
+// pageMessages loads the page described by form. getBefore and getAfter
+// return up to limit messages below or above a cursor, oldest first, as
+// MessageModel.GetBefore and GetAfter do.
+func pageMessages(form messagePageForm, getBefore, getAfter func(cursor, limit int) ([]*models.Message, error)) (*messagePage, error) {
+	// One extra row is fetched to find out whether there is another page in
+	// the direction being walked.
+	page := &messagePage{}
+	if form.After > 0 {
+		messages, err := getAfter(form.After, form.Limit+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > form.Limit {
+			messages = messages[:form.Limit]
+			page.next = &messages[len(messages)-1].ID
+		}
+		cursor := form.After + 1
+		page.prev = &cursor
+		if len(messages) > 0 {
+			page.prev = &messages[0].ID
+		}
+		page.messages = messages
+		return page, nil
+	}
+
+	messages, err := getBefore(form.Before, form.Limit+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) > form.Limit {
+		messages = messages[1:]
+		page.prev = &messages[0].ID
+	}
+	if form.Before > 0 {
+		cursor := form.Before - 1
+		page.next = &cursor
+		if len(messages) > 0 {
+			page.next = &messages[len(messages)-1].ID
+		}
+	}
+	page.messages = messages
+	return page, nil
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"go.chat/internal/models"
+)
+
+func TestNewMessagePageForm(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		want   messagePageForm
+		errors []string
+	}{
+		{name: "Defaults", query: "", want: messagePageForm{Limit: 50}},
+		{name: "Before", query: "?before=10&limit=20", want: messagePageForm{Before: 10, Limit: 20}},
+		{name: "After", query: "?after=10", want: messagePageForm{After: 10, Limit: 50}},
+		{name: "Not an integer", query: "?before=abc", errors: []string{"before"}},
+		{name: "Negative", query: "?after=-1", errors: []string{"after"}},
+		{name: "Before and after", query: "?before=10&after=5", errors: []string{"before"}},
+		{name: "Zero limit", query: "?limit=0", errors: []string{"limit"}},
+		{name: "Limit too large", query: "?limit=101", errors: []string{"limit"}},
+		{name: "Several errors", query: "?before=-1&limit=x", errors: []string{"before", "limit"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/chat/messages/1"+tt.query, nil)
+			form := newMessagePageForm(r)
+
+			var fields []string
+			for field := range form.FieldErrors {
+				fields = append(fields, field)
+			}
+			slices.Sort(fields)
+			if !slices.Equal(fields, tt.errors) {
+				t.Fatalf("got errors %v; want %v", form.FieldErrors, tt.errors)
+			}
+			if tt.errors != nil {
+				return
+			}
+			if form.Before != tt.want.Before || form.After != tt.want.After || form.Limit != tt.want.Limit {
+				t.Errorf("got before=%d after=%d limit=%d; want before=%d after=%d limit=%d",
+					form.Before, form.After, form.Limit, tt.want.Before, tt.want.After, tt.want.Limit)
+			}
+		})
+	}
+}
+
+// messageStore fakes MessageModel.GetBefore and GetAfter over messages with
+// IDs 1 to n.
+type messageStore struct {
+	n int
+}
+
+func (s messageStore) getBefore(cursor, limit int) ([]*models.Message, error) {
+	end := s.n
+	if cursor > 0 {
+		end = min(cursor-1, s.n)
+	}
+	return s.messages(max(end-limit+1, 1), end), nil
+}
+
+func (s messageStore) getAfter(cursor, limit int) ([]*models.Message, error) {
+	start := cursor + 1
+	return s.messages(start, min(start+limit-1, s.n)), nil
+}
+
+func (s messageStore) messages(first, last int) []*models.Message {
+	messages := []*models.Message{}
+	for id := first; id <= last; id++ {
+		messages = append(messages, &models.Message{ID: id})
+	}
+	return messages
+}
+
+func TestPageMessages(t *testing.T) {
+	intPtr := func(n int) *int { return &n }
+	store := messageStore{n: 10}
+
+	tests := []struct {
+		name string
+		form messagePageForm
+		ids  []int
+		prev *int
+		next *int
+	}{
+		{name: "Latest page", form: messagePageForm{Limit: 3}, ids: []int{8, 9, 10}, prev: intPtr(8)},
+		{name: "All messages", form: messagePageForm{Limit: 50}, ids: []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{name: "Before", form: messagePageForm{Before: 5, Limit: 3}, ids: []int{2, 3, 4}, prev: intPtr(2), next: intPtr(4)},
+		{name: "Before first page", form: messagePageForm{Before: 3, Limit: 3}, ids: []int{1, 2}, next: intPtr(2)},
+		{name: "After", form: messagePageForm{After: 5, Limit: 3}, ids: []int{6, 7, 8}, prev: intPtr(6), next: intPtr(8)},
+		{name: "After last page", form: messagePageForm{After: 8, Limit: 3}, ids: []int{9, 10}, prev: intPtr(9)},
+		{name: "After the end", form: messagePageForm{After: 10, Limit: 3}, ids: []int{}, prev: intPtr(11)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := pageMessages(tt.form, store.getBefore, store.getAfter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := []int{}
+			for _, m := range page.messages {
+				ids = append(ids, m.ID)
+			}
+			if !slices.Equal(ids, tt.ids) {
+				t.Errorf("got messages %v; want %v", ids, tt.ids)
+			}
+			checkCursor(t, "prev", page.prev, tt.prev)
+			checkCursor(t, "next", page.next, tt.next)
+		})
+	}
+}
+
+func TestPageMessagesError(t *testing.T) {
+	errStore := errors.New("store failed")
+	fail := func(cursor, limit int) ([]*models.Message, error) {
+		return nil, errStore
+	}
+
+	for _, form := range []messagePageForm{{Limit: 10}, {After: 1, Limit: 10}} {
+		_, err := pageMessages(form, fail, fail)
+		if err != errStore {
+			t.Errorf("after=%d: got error %v; want %v", form.After, err, errStore)
+		}
+	}
+}
+
+func checkCursor(t *testing.T, name string, got, want *int) {
+	t.Helper()
+	switch {
+	case got == nil && want == nil:
+	case got == nil || want == nil:
+		t.Errorf("got %s %v; want %v", name, fmtCursor(got), fmtCursor(want))
+	case *got != *want:
+		t.Errorf("got %s %d; want %d", name, *got, *want)
+	}
+}
+
+func fmtCursor(p *int) any {
+	if p == nil {
+		return "none"
+	}
+	return *p
+}
+
+func TestNewSearchForm(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		errors []string
+	}{
+		{name: "Words", query: "?q=deploy+api"},
+		{name: "Attachments only", query: "?q=has:attachment"},
+		{name: "Sender only", query: "?sender_id=3"},
+		{name: "Dates only", query: "?from=2024-01-01&to=2024-01-31"},
+		{name: "Nothing to search for", query: "?q=%3F%21", errors: []string{"q"}},
+		{name: "Empty", query: "", errors: []string{"q"}},
+		{name: "Not integers", query: "?q=go&chat_id=x&sender_id=y&offset=z&limit=w", errors: []string{"chat_id", "limit", "offset", "sender_id"}},
+		{name: "Bad date", query: "?q=go&from=yesterday", errors: []string{"from"}},
+		{name: "From after to", query: "?q=go&from=2024-02-01&to=2024-01-01", errors: []string{"from"}},
+		{name: "Limit too large", query: "?q=go&limit=51", errors: []string{"limit"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/search"+tt.query, nil)
+			form := newSearchForm(r)
+
+			var fields []string
+			for field := range form.FieldErrors {
+				fields = append(fields, field)
+			}
+			slices.Sort(fields)
+			if !slices.Equal(fields, tt.errors) {
+				t.Errorf("got errors %v; want %v", form.FieldErrors, tt.errors)
+			}
+		})
+	}
+}
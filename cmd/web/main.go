@@ -2,14 +2,20 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"go.chat/internal/jwt"
 	"go.chat/internal/models"
+	"go.chat/internal/search"
+	"go.chat/internal/storage"
 )
 
 type application struct {
@@ -20,34 +26,108 @@ type application struct {
 	chats        *models.ChatModel
 	messages     *models.MessageModel
 	participants *models.ParticipantModel
+	invites      *models.InviteModel
+	sessions     *models.SessionModel
+	apiTokens    *models.APITokenModel
+	threads      *models.ThreadFollowerModel
+	reactions    *models.ReactionModel
+	attachments  *models.AttachmentModel
+	blobs        storage.BlobStore
+	search       search.Engine
 	hub          *Hub
+	tickets      *ticketStore
+	commands     *commandRegistry
+	wsConfig     wsConfig
+	editWindow   time.Duration
+	uploads      uploadConfig
+	refreshTTL   time.Duration
 }
 
 func main() {
 	addr := flag.String("addr", ":4000", "HTTP network address")
 	dsn := flag.String("dsn", "web:beans@/gochat?parseTime=true", "MySql dsn")
-	secretKey := flag.String("secret-key", "your-secret-key", "JWT secret key")
+	secretKey := flag.String("secret-key", "", "JWT HMAC secret of at least 32 bytes, used to sign tokens unless -jwt-key is set")
+	jwtKey := flag.String("jwt-key", "", "PEM file of the Ed25519 or RSA private key to sign tokens with")
+	jwtVerifyKeys := flag.String("jwt-verify-keys", "", "Comma separated PEM files of further keys to accept tokens from")
+	accessTTL := flag.Duration("access-token-ttl", 15*time.Minute, "How long access tokens are valid for")
+	refreshTTL := flag.Duration("refresh-token-ttl", 30*24*time.Hour, "How long refresh tokens are valid for")
+	wsWriteWait := flag.Duration("ws-write-wait", 10*time.Second, "Time allowed to write a WebSocket frame")
+	wsPongWait := flag.Duration("ws-pong-wait", 60*time.Second, "Time allowed to read the next WebSocket pong")
+	wsPingPeriod := flag.Duration("ws-ping-period", 54*time.Second, "Interval between WebSocket pings, must be less than -ws-pong-wait")
+	editWindow := flag.Duration("edit-window", 15*time.Minute, "How long after sending a message its author can edit it")
+	wsMaxMessageSize := flag.Int64("ws-max-message-size", 4096, "Maximum WebSocket frame size in bytes")
+	uploadDir := flag.String("upload-dir", "./uploads", "Directory where attachments are stored")
+	maxUploadSize := flag.Int64("max-upload-size", 10<<20, "Maximum attachment size in bytes")
+	maxUploadFiles := flag.Int("max-upload-files", 10, "Maximum number of attachments per message")
+	uploadTimeout := flag.Duration("upload-timeout", 2*time.Minute, "Time allowed for a request with attachments")
+	commandsFile := flag.String("commands", "", "JSON file of custom slash commands answered by HTTP endpoints")
 	flag.Parse()
 	infolog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorlog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
+	if *wsPingPeriod >= *wsPongWait {
+		errorlog.Fatal("-ws-ping-period must be less than -ws-pong-wait")
+	}
+
+	keys, err := loadKeySet(*secretKey, *jwtKey, *jwtVerifyKeys)
+	if err != nil {
+		errorlog.Fatal(err)
+	}
+
 	db, err := openDB(*dsn)
 	if err != nil {
 		errorlog.Fatal(err)
 	}
 	defer db.Close()
+
+	blobs, err := storage.NewLocalStore(*uploadDir)
+	if err != nil {
+		errorlog.Fatal(err)
+	}
+
 	app := &application{
 		errorLog:     errorlog,
 		infoLog:      infolog,
 		users:        &models.UserModel{DB: db},
-		jwt:          jwt.NewManager(*secretKey),
+		jwt:          jwt.NewManager(keys, *accessTTL),
 		chats:        &models.ChatModel{DB: db},
 		messages:     &models.MessageModel{DB: db},
 		participants: &models.ParticipantModel{DB: db},
+		invites:      &models.InviteModel{DB: db},
+		sessions:     &models.SessionModel{DB: db},
+		apiTokens:    &models.APITokenModel{DB: db},
+		threads:      &models.ThreadFollowerModel{DB: db},
+		reactions:    &models.ReactionModel{DB: db},
+		attachments:  &models.AttachmentModel{DB: db},
+		blobs:        blobs,
+		search:       &search.MySQLEngine{DB: db},
 		hub:          newHub(),
+		tickets:      newTicketStore(),
+		commands:     newCommandRegistry(),
+		wsConfig: wsConfig{
+			writeWait:      *wsWriteWait,
+			pongWait:       *wsPongWait,
+			pingPeriod:     *wsPingPeriod,
+			maxMessageSize: *wsMaxMessageSize,
+		},
+		editWindow: *editWindow,
+		refreshTTL: *refreshTTL,
+		uploads: uploadConfig{
+			maxSize:  *maxUploadSize,
+			maxFiles: *maxUploadFiles,
+			timeout:  *uploadTimeout,
+		},
+	}
+
+	if *commandsFile != "" {
+		err = app.commands.loadHookCommands(*commandsFile, app.users)
+		if err != nil {
+			errorlog.Fatal(err)
+		}
 	}
 
 	go app.hub.run()
+	go app.publishPresence()
 
 	srv := &http.Server{
 		Addr:     *addr,
@@ -59,6 +139,50 @@ func main() {
 	errorlog.Fatal(err)
 }
 
+// minSecretBytes is the shortest HMAC secret accepted, the size of an
+// HS256 key.
+const minSecretBytes = 32
+
+// loadKeySet builds the JWT keys from the flags. One of the HMAC secret and
+// the signing key file must be given. Without a signing key file tokens are
+// signed with the HMAC secret; with one, the secret is only kept for
+// verifying older tokens.
+func loadKeySet(secret, signingFile, verifyFiles string) (*jwt.KeySet, error) {
+	if secret == "" && signingFile == "" {
+		return nil, errors.New("-secret-key or -jwt-key is required to sign tokens")
+	}
+	if secret != "" && len(secret) < minSecretBytes {
+		return nil, fmt.Errorf("-secret-key must be at least %d bytes long", minSecretBytes)
+	}
+
+	var hmacKey *jwt.Key
+	if secret != "" {
+		hmacKey = jwt.NewHMACKey("hs256", secret)
+	}
+	if signingFile == "" {
+		return jwt.NewKeySet(hmacKey)
+	}
+
+	signing, err := jwt.LoadKeyFile(signingFile)
+	if err != nil {
+		return nil, err
+	}
+	var verify []*jwt.Key
+	if hmacKey != nil {
+		verify = append(verify, hmacKey)
+	}
+	if verifyFiles != "" {
+		for _, path := range strings.Split(verifyFiles, ",") {
+			key, err := jwt.LoadKeyFile(strings.TrimSpace(path))
+			if err != nil {
+				return nil, err
+			}
+			verify = append(verify, key)
+		}
+	}
+	return jwt.NewKeySet(signing, verify...)
+}
+
 func openDB(dsn string) (*sql.DB, error) {
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
@@ -2,13 +2,36 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"go.chat/internal/jwt"
 )
 
+const requestIDHeader = "X-Request-Id"
+
+// requestID tags every request with a random ID, returned in the
+// X-Request-Id header and in error responses, and logged with the request.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 8)
+		_, err := rand.Read(b)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		w.Header().Set(requestIDHeader, hex.EncodeToString(b))
+		next.ServeHTTP(w, r)
+	})
+}
+
 func secureHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Security-Policy",
@@ -23,7 +46,7 @@ func secureHeaders(next http.Handler) http.Handler {
 
 func (app *application) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.infoLog.Printf("%s - %s %s %s", r.RemoteAddr, r.Proto, r.Method, r.URL.RequestURI())
+		app.infoLog.Printf("%s %s - %s %s %s", w.Header().Get(requestIDHeader), r.RemoteAddr, r.Proto, r.Method, r.URL.RequestURI())
 		next.ServeHTTP(w, r)
 	})
 }
@@ -40,37 +63,128 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// requireAuth lets through requests authenticated as a user, by an access
+// token in an "Authorization: Bearer" header or in the token cookie. API
+// tokens are recognised but refused; routes open to them use requireScope.
 func (app *application) requireAuth(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("token")
-		if err != nil {
-			app.clientError(w, http.StatusUnauthorized)
-			return
-		}
+	return app.requireScope("")(next)
+}
 
-		claims, err := app.jwt.ValidateToken(cookie.Value)
-		if err != nil {
-			switch err {
-			case jwt.ErrInvalidToken:
+// requireScope is requireAuth for routes that API tokens granted scope may
+// use as well.
+func (app *application) requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok, err := bearerToken(r)
+			if err != nil {
 				app.clientError(w, http.StatusUnauthorized)
-			case jwt.ErrExpiredToken:
+				return
+			}
+			if !ok {
+				cookie, err := r.Cookie(accessCookie)
+				if err != nil {
+					app.clientError(w, http.StatusUnauthorized)
+					return
+				}
+				token = cookie.Value
+			}
+
+			app.serveWithToken(w, r, token, scope, next)
+		})
+	}
+}
+
+// requireWebSocketAuth authenticates WebSocket upgrades, which browsers
+// cannot add headers to. Besides what requireScope(scopeWebSocket) accepts,
+// it takes a one-time ticket in the ticket query parameter, or a token
+// offered as a "bearer.<token>" subprotocol.
+func (app *application) requireWebSocketAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+			claims, ok := app.tickets.redeem(ticket)
+			if !ok {
 				app.clientError(w, http.StatusUnauthorized)
-			default:
-				app.serverError(w, err)
+				return
 			}
+			app.serveAs(w, r, claims, next)
 			return
 		}
 
-		ctx := r.Context()
-		ctx = context.WithValue(ctx, "user_id", claims.UserID)
-		ctx = context.WithValue(ctx, "email", claims.Email)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		for _, protocol := range websocket.Subprotocols(r) {
+			if token, ok := strings.CutPrefix(protocol, bearerProtocolPrefix); ok {
+				app.serveWithToken(w, r, token, scopeWebSocket, next)
+				return
+			}
+		}
+
+		app.requireScope(scopeWebSocket)(next).ServeHTTP(w, r)
 	})
 }
 
+// serveWithToken validates the access or API token and serves the request
+// as its user. API tokens must be granted scope.
+func (app *application) serveWithToken(w http.ResponseWriter, r *http.Request, token, scope string, next http.Handler) {
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		app.serveWithAPIToken(w, r, token, scope, next)
+		return
+	}
+
+	claims, err := app.jwt.ValidateToken(token)
+	if err != nil {
+		switch err {
+		case jwt.ErrInvalidToken:
+			app.clientError(w, http.StatusUnauthorized)
+		case jwt.ErrExpiredToken:
+			app.clientError(w, http.StatusUnauthorized)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+	app.serveAs(w, r, claims, next)
+}
+
+// serveAs checks that the session of claims has not been revoked and serves
+// the request with the user's identity in its context.
+func (app *application) serveAs(w http.ResponseWriter, r *http.Request, claims *jwt.Claims, next http.Handler) {
+	active, err := app.sessions.Active(claims.SessionID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if !active {
+		app.clientError(w, http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	ctx = context.WithValue(ctx, "user_id", claims.UserID)
+	ctx = context.WithValue(ctx, "email", claims.Email)
+	ctx = context.WithValue(ctx, "session_id", claims.SessionID)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header. ok is
+// false when there is no Authorization header; other schemes are an error.
+func bearerToken(r *http.Request) (token string, ok bool, err error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", false, nil
+	}
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false, errors.New("malformed Authorization header")
+	}
+	return strings.TrimSpace(token), true, nil
+}
+
 func (app *application) requestTimeout(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		timeout := 10 * time.Second
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+			timeout = app.uploads.timeout
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
 		defer cancel()
 
 		done := make(chan struct{})
@@ -83,8 +197,8 @@ func (app *application) requestTimeout(next http.Handler) http.Handler {
 		case <-done:
 			return
 		case <-ctx.Done():
-			app.errorLog.Printf("Request timed out: %s %s", r.Method, r.URL.Path)
-			app.serverError(w, ctx.Err())
+			app.errorLog.Printf("Request %s timed out: %s %s", w.Header().Get(requestIDHeader), r.Method, r.URL.Path)
+			app.errorResponse(w, http.StatusServiceUnavailable, "timeout", "The request took too long to process", nil)
 		}
 	})
 }
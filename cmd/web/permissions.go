@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"go.chat/internal/models"
+)
+
+var errForbidden = errors.New("action not allowed for role")
+
+// permission is an action on a chat that requires a minimum role.
+type permission int
+
+const (
+	permRead permission = iota
+	permPost
+	permDeleteAnyMessage
+	permManageMembers
+	permManageRoles
+	permTransferOwnership
+	permSetTopic
+)
+
+var requiredRole = map[permission]string{
+	permRead:              models.RoleMember,
+	permPost:              models.RoleMember,
+	permDeleteAnyMessage:  models.RoleAdmin,
+	permManageMembers:     models.RoleAdmin,
+	permManageRoles:       models.RoleOwner,
+	permTransferOwnership: models.RoleOwner,
+	permSetTopic:          models.RoleAdmin,
+}
+
+// roleRank orders roles from least to most privileged.
+func roleRank(role string) int {
+	switch role {
+	case models.RoleOwner:
+		return 2
+	case models.RoleAdmin:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// authorize checks that the chat exists and that the user's role in it grants
+// perm. It returns the user's role, or errChatNotFound, errNotParticipant or
+// errForbidden.
+func (app *application) authorize(chatID, userID int, perm permission) (string, error) {
+	exists, err := app.chats.ExistsId(chatID)
+	if err != nil {
+		app.errorLog.Printf("Error checking chat existence: %v", err)
+		return "", err
+	}
+	if !exists {
+		return "", errChatNotFound
+	}
+
+	role, err := app.participants.GetRole(chatID, userID)
+	if err != nil {
+		if err == models.ErrNoRecord {
+			return "", errNotParticipant
+		}
+		app.errorLog.Printf("Error getting role of user %d in chat %d: %v", userID, chatID, err)
+		return "", err
+	}
+
+	if roleRank(role) < roleRank(requiredRole[perm]) {
+		return role, errForbidden
+	}
+	return role, nil
+}
+
+// checkNotMuted returns errMuted if the user is muted in the chat.
+func (app *application) checkNotMuted(chatID, userID int) error {
+	mutedUntil, err := app.participants.MutedUntil(chatID, userID)
+	if err != nil {
+		app.errorLog.Printf("Error checking mute of user %d in chat %d: %v", userID, chatID, err)
+		return err
+	}
+	if mutedUntil != nil {
+		return errMuted
+	}
+	return nil
+}
+
+// authorizeError writes the response for an error returned by authorize.
+func (app *application) authorizeError(w http.ResponseWriter, err error) {
+	switch err {
+	case errChatNotFound:
+		app.clientError(w, http.StatusNotFound)
+	case errNotParticipant, errForbidden:
+		app.clientError(w, http.StatusForbidden)
+	case errMuted:
+		app.errorResponse(w, http.StatusForbidden, "muted", "You are muted in this chat", nil)
+	default:
+		app.serverError(w, err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	statusOnline  = "online"
+	statusAway    = "away"
+	statusOffline = "offline"
+)
+
+type awayEvent struct {
+	client *Client
+	away   bool
+}
+
+type presenceChange struct {
+	userID int
+	status string
+	at     time.Time
+}
+
+// presenceChanges recomputes the status of every dirty user and returns the
+// ones that changed. A user is online while at least one of their
+// connections is not away, away while all of them are, and offline once the
+// last one is gone.
+func (h *Hub) presenceChanges() []presenceChange {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var changes []presenceChange
+	for userID := range h.dirty {
+		status := statusOffline
+		for client := range h.userClients[userID] {
+			if !client.away {
+				status = statusOnline
+				break
+			}
+			status = statusAway
+		}
+
+		old, ok := h.statuses[userID]
+		if !ok {
+			old = statusOffline
+		}
+		if status != old {
+			changes = append(changes, presenceChange{userID: userID, status: status, at: time.Now().UTC()})
+		}
+		if status == statusOffline {
+			delete(h.statuses, userID)
+		} else {
+			h.statuses[userID] = status
+		}
+		delete(h.dirty, userID)
+	}
+	return changes
+}
+
+// status returns the current presence status of the user.
+func (h *Hub) status(userID int) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if status, ok := h.statuses[userID]; ok {
+		return status
+	}
+	return statusOffline
+}
+
+// sendToUsers queues message on every connection of the given users.
+func (h *Hub) sendToUsers(userIDs []int, message []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, userID := range userIDs {
+		for client := range h.userClients[userID] {
+			h.deliver(client, message)
+		}
+	}
+}
+
+// publishPresence records last_seen for every presence change reported by the
+// hub and pushes a "presence" frame to the users who share a chat with the
+// user concerned. It runs for the lifetime of the application.
+func (app *application) publishPresence() {
+	for change := range app.hub.presence {
+		err := app.users.UpdateLastSeen(change.userID, change.at)
+		if err != nil {
+			app.errorLog.Printf("Error updating last seen for user %d: %v", change.userID, err)
+		}
+
+		userIDs, err := app.participants.GetContactIDs(change.userID)
+		if err != nil {
+			app.errorLog.Printf("Error getting contacts of user %d: %v", change.userID, err)
+			continue
+		}
+
+		messageBytes, err := json.Marshal(Message{
+			Type:    "presence",
+			UserID:  change.userID,
+			Status:  change.status,
+			Created: &change.at,
+		})
+		if err != nil {
+			app.errorLog.Printf("Error marshaling presence: %v", err)
+			continue
+		}
+		app.hub.sendToUsers(userIDs, messageBytes)
+	}
+}
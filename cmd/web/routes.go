@@ -13,19 +13,57 @@ func (app *application) routes() http.Handler {
 	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		app.notFound(w)
 	})
+	router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.clientError(w, http.StatusMethodNotAllowed)
+	})
 
 	// Public routes
 	router.HandlerFunc(http.MethodGet, "/", app.home)
+	router.HandlerFunc(http.MethodGet, "/.well-known/jwks.json", app.jwks)
 	router.HandlerFunc(http.MethodPost, "/user/register", app.userRegister)
 	router.HandlerFunc(http.MethodPost, "/user/login", app.userLogin)
+	router.HandlerFunc(http.MethodPost, "/user/refresh", app.userRefresh)
+	router.HandlerFunc(http.MethodPost, "/user/logout", app.userLogout)
 
-	// Protected routes
+	// Protected routes. API tokens may only use the routes of their scopes.
 	protected := alice.New(app.requireAuth)
+	read := alice.New(app.requireScope(scopeRead))
+	write := alice.New(app.requireScope(scopeWrite))
+	join := alice.New(app.requireScope(scopeJoin))
 	router.Handler(http.MethodPost, "/chat/create", protected.ThenFunc(app.createChat))
-	router.Handler(http.MethodPost, "/chat/message", protected.ThenFunc(app.sendMessage))
-	router.Handler(http.MethodGet, "/chat/messages/:chat_id", protected.ThenFunc(app.getMessages))
-	router.Handler(http.MethodPost, "/chat/join", protected.ThenFunc(app.joinChat))
-	router.Handler(http.MethodGet, "/ws", protected.ThenFunc(app.handleWebSocket))
-	standard := alice.New(app.recoverPanic, app.logRequest, secureHeaders, app.requestTimeout)
+	router.Handler(http.MethodPost, "/dm/:user_id", protected.ThenFunc(app.openDirectChat))
+	router.Handler(http.MethodPost, "/chat/message", write.ThenFunc(app.sendMessage))
+	router.Handler(http.MethodPost, "/chat/message/edit", write.ThenFunc(app.editMessage))
+	router.Handler(http.MethodPost, "/chat/message/delete", write.ThenFunc(app.deleteMessage))
+	router.Handler(http.MethodPost, "/chat/message/react", write.ThenFunc(app.addReaction))
+	router.Handler(http.MethodPost, "/chat/message/unreact", write.ThenFunc(app.removeReaction))
+	router.Handler(http.MethodGet, "/chat/message/:message_id/history", read.ThenFunc(app.getMessageHistory))
+	router.Handler(http.MethodGet, "/attachments/:attachment_id", read.ThenFunc(app.downloadAttachment))
+	router.Handler(http.MethodGet, "/chat/thread/:message_id", read.ThenFunc(app.getThread))
+	router.Handler(http.MethodPost, "/chat/thread/follow", protected.ThenFunc(app.followThread))
+	router.Handler(http.MethodPost, "/chat/thread/unfollow", protected.ThenFunc(app.unfollowThread))
+	router.Handler(http.MethodGet, "/chat/messages/:chat_id", read.ThenFunc(app.getMessages))
+	router.Handler(http.MethodPost, "/chat/join", join.ThenFunc(app.joinChat))
+	router.Handler(http.MethodPost, "/chat/leave", join.ThenFunc(app.leaveChat))
+	router.Handler(http.MethodPost, "/chat/remove", protected.ThenFunc(app.removeMember))
+	router.Handler(http.MethodPost, "/chat/role", protected.ThenFunc(app.setMemberRole))
+	router.Handler(http.MethodPost, "/chat/transfer", protected.ThenFunc(app.transferOwnership))
+	router.Handler(http.MethodPost, "/chat/invite", protected.ThenFunc(app.createInvite))
+	router.Handler(http.MethodGet, "/chat/invites/:chat_id", protected.ThenFunc(app.listInvites))
+	router.Handler(http.MethodPost, "/chat/invite/revoke", protected.ThenFunc(app.revokeInvite))
+	router.Handler(http.MethodPost, "/chat/invite/accept", join.ThenFunc(app.acceptInvite))
+	router.Handler(http.MethodPost, "/chat/read", write.ThenFunc(app.markChatRead))
+	router.Handler(http.MethodGet, "/chats", read.ThenFunc(app.listChats))
+	router.Handler(http.MethodGet, "/chats/unread", read.ThenFunc(app.getUnreadCounts))
+	router.Handler(http.MethodGet, "/search", read.ThenFunc(app.searchMessages))
+	router.Handler(http.MethodGet, "/users/presence", read.ThenFunc(app.getPresence))
+	router.Handler(http.MethodPost, "/bots", protected.ThenFunc(app.createBot))
+	router.Handler(http.MethodGet, "/bots", protected.ThenFunc(app.listBots))
+	router.Handler(http.MethodPost, "/tokens", protected.ThenFunc(app.createAPIToken))
+	router.Handler(http.MethodGet, "/tokens", protected.ThenFunc(app.listAPITokens))
+	router.Handler(http.MethodPost, "/tokens/revoke", protected.ThenFunc(app.revokeAPIToken))
+	router.Handler(http.MethodPost, "/ws/ticket", protected.ThenFunc(app.createWebSocketTicket))
+	router.Handler(http.MethodGet, "/ws", alice.New(app.requireWebSocketAuth).ThenFunc(app.handleWebSocket))
+	standard := alice.New(app.requestID, app.recoverPanic, app.logRequest, secureHeaders, app.requestTimeout)
 	return standard.Then(router)
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.chat/internal/jwt"
+)
+
+const (
+	// wsProtocol is the WebSocket subprotocol spoken by the server. Clients
+	// sending their token as a bearerProtocolPrefix subprotocol must offer
+	// it too, since the token is never echoed back.
+	wsProtocol           = "gochat"
+	bearerProtocolPrefix = "bearer."
+
+	wsTicketTTL = 30 * time.Second
+)
+
+type wsTicket struct {
+	claims  *jwt.Claims
+	expires time.Time
+}
+
+// ticketStore holds the one-time tickets that authenticate a WebSocket
+// upgrade. Tickets live in memory only, so they must be redeemed on the
+// instance that issued them.
+type ticketStore struct {
+	mu      sync.Mutex
+	tickets map[string]wsTicket
+}
+
+func newTicketStore() *ticketStore {
+	return &ticketStore{tickets: make(map[string]wsTicket)}
+}
+
+// issue returns a new ticket standing for claims for wsTicketTTL. Expired
+// tickets are dropped on the way.
+func (s *ticketStore) issue(claims *jwt.Claims) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, t := range s.tickets {
+		if now.After(t.expires) {
+			delete(s.tickets, k)
+		}
+	}
+	s.tickets[id] = wsTicket{claims: claims, expires: now.Add(wsTicketTTL)}
+	return id, nil
+}
+
+// redeem returns the claims of the ticket and invalidates it.
+func (s *ticketStore) redeem(id string) (*jwt.Claims, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tickets[id]
+	if !ok {
+		return nil, false
+	}
+	delete(s.tickets, id)
+	if time.Now().After(t.expires) {
+		return nil, false
+	}
+	return t.claims, true
+}
+
+// createWebSocketTicket issues a one-time ticket for opening a WebSocket as
+// the current user with /ws?ticket=.
+func (app *application) createWebSocketTicket(w http.ResponseWriter, r *http.Request) {
+	claims := &jwt.Claims{
+		UserID:    r.Context().Value("user_id").(int),
+		Email:     r.Context().Value("email").(string),
+		SessionID: r.Context().Value("session_id").(int),
+	}
+	ticket, err := app.tickets.issue(claims)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"ticket":     ticket,
+		"expires_in": int(wsTicketTTL.Seconds()),
+	})
+}
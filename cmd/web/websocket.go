@@ -3,39 +3,222 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"go.chat/internal/models"
 )
 
+// wsConfig holds the WebSocket heartbeat and frame size settings.
+type wsConfig struct {
+	// writeWait is the time allowed to write a frame to the peer.
+	writeWait time.Duration
+	// pongWait is the time allowed to read the next pong from the peer.
+	pongWait time.Duration
+	// pingPeriod is how often pings are sent. It must be less than pongWait.
+	pingPeriod time.Duration
+	// maxMessageSize is the maximum frame size in bytes allowed from the peer.
+	maxMessageSize int64
+}
+
 type Client struct {
+	app    *application
 	hub    *Hub
 	conn   *websocket.Conn
 	send   chan []byte
 	userID int
+	// sessionID is the login the connection was opened with, or 0 for API
+	// tokens.
+	sessionID int
+	// apiTokenID is the API token the connection was opened with, or 0 for
+	// logins.
+	apiTokenID int
+	// scopes are those of the API token the connection was opened with, or
+	// nil for logins, which may send every frame.
+	scopes []string
+	// chats holds the IDs of the rooms the client is subscribed to. It is
+	// guarded by hub.mu.
+	chats map[int]bool
+	// pending holds live frames for chats whose missed messages are still
+	// being replayed. It is guarded by hub.mu.
+	pending map[int][]heldFrame
+	// away is set by the client's "presence" frames. It is guarded by hub.mu.
+	away bool
+	// holding is set when the client connected without a resume parameter
+	// and may send a "resume" frame first. Its live frames are held in
+	// pending until release is called.
+	holding     bool
+	releaseOnce sync.Once
+}
+
+type subscription struct {
+	client *Client
+	chatID int
+}
+
+// membership identifies a user's place in a chat. It is sent on hub.join and
+// hub.leave when the user becomes or stops being a participant.
+type membership struct {
+	userID int
+	chatID int
+}
+
+// heldFrame is a live frame held back during a replay. id is the message ID
+// of "message" and "system" frames and 0 for any other frame.
+type heldFrame struct {
+	id      int
+	message []byte
+}
+
+// replayBatch carries the messages a resuming client missed in one chat.
+// Truncated is set when there were more than maxReplay of them.
+type replayBatch struct {
+	client    *Client
+	chatID    int
+	messages  []*models.Message
+	truncated bool
+}
+
+// typingEvent is sent to the hub when a client starts or stops typing, and by
+// the expiry timer of a typing indicator, in which case expired is set.
+type typingEvent struct {
+	client  *Client
+	chatID  int
+	userID  int
+	start   bool
+	expired *typist
+}
+
+type typist struct {
+	timer *time.Timer
+}
+
+type typingKey struct {
+	chatID int
+	userID int
 }
 
+// typingTimeout is how long a typing indicator lasts without a new
+// "typing_start" frame from the client.
+const typingTimeout = 5 * time.Second
+
+// resumeWait is how long the live frames of a client that may send a
+// "resume" frame are held when it sends no frame at all.
+const resumeWait = 2 * time.Second
+
+// maxReplay caps the number of missed messages replayed per chat on resume.
+// Clients are told when the cap is hit and can fetch the rest from
+// GET /chat/messages.
+const maxReplay = 100
+
+// Hub keeps track of connected clients and of the chat rooms they are
+// subscribed to. chatClients is keyed by chat ID and userClients by user ID.
 type Hub struct {
+	clients     map[*Client]bool
 	chatClients map[int]map[*Client]bool
+	userClients map[int]map[*Client]bool
 	broadcast   chan []byte
 	register    chan *Client
 	unregister  chan *Client
-	mu          sync.RWMutex
+	// revoke receives the IDs of revoked sessions, whose connections are
+	// closed.
+	revoke chan int
+	// revokeToken receives the IDs of revoked API tokens, whose connections
+	// are closed.
+	revokeToken chan int
+	subscribe   chan subscription
+	unsubscribe chan subscription
+	join        chan membership
+	leave       chan membership
+	replay      chan replayBatch
+	typing      chan typingEvent
+	// typists holds the users currently typing in each chat. It is guarded by
+	// mu.
+	typists map[typingKey]*typist
+	away    chan awayEvent
+	// statuses holds the presence of every user with a live connection, and
+	// dirty the users whose presence may have changed since it was last
+	// published. Both are guarded by mu.
+	statuses map[int]string
+	dirty    map[int]bool
+	// presence receives every change of a user's presence status.
+	presence chan presenceChange
+	mu       sync.RWMutex
 }
 
 type Message struct {
-	Type    string `json:"type"`
-	Content string `json:"content"`
-	ChatID  int    `json:"chat_id"`
-	UserID  int    `json:"user_id"`
+	Type    string     `json:"type"`
+	ID      int        `json:"id,omitempty"`
+	Content string     `json:"content"`
+	ChatID  int        `json:"chat_id"`
+	UserID  int        `json:"user_id"`
+	Bot     bool       `json:"bot,omitempty"`
+	Created *time.Time `json:"created,omitempty"`
+	// Nonce is chosen by the client when sending a message and echoed back in
+	// the matching "ack" or "error" frame.
+	Nonce string `json:"nonce,omitempty"`
+	// Status is the presence status carried by "presence" frames.
+	Status   string     `json:"status,omitempty"`
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	Deleted  bool       `json:"deleted,omitempty"`
+	// ParentID is set on thread replies; ReplyCount and LastReplyAt on
+	// "thread_updated" frames.
+	ParentID    *int       `json:"parent_id,omitempty"`
+	ReplyCount  int        `json:"reply_count,omitempty"`
+	LastReplyAt *time.Time `json:"last_reply_at,omitempty"`
+	// Emoji and Count are carried by "reaction_added" and "reaction_removed"
+	// frames; Count is the number of reactions left with that emoji.
+	Emoji       string               `json:"emoji,omitempty"`
+	Count       *int                 `json:"count,omitempty"`
+	Attachments []*models.Attachment `json:"attachments,omitempty"`
+	// LastSeen maps chat IDs to the last message ID the client saw, in
+	// "resume" frames.
+	LastSeen map[int]int `json:"last_seen,omitempty"`
+}
+
+func newMessageFrame(m *models.Message) Message {
+	typ := "message"
+	if m.IsSystem {
+		typ = "system"
+	}
+	return Message{
+		Type:        typ,
+		ID:          m.ID,
+		Content:     m.Content,
+		ChatID:      m.ChatID,
+		UserID:      m.SenderID,
+		Bot:         m.IsBot,
+		Created:     &m.Created,
+		EditedAt:    m.EditedAt,
+		Deleted:     m.Deleted,
+		ParentID:    m.ParentID,
+		Attachments: m.Attachments,
+	}
 }
 
 func newHub() *Hub {
 	return &Hub{
+		clients:     make(map[*Client]bool),
 		chatClients: make(map[int]map[*Client]bool),
+		userClients: make(map[int]map[*Client]bool),
 		broadcast:   make(chan []byte),
 		register:    make(chan *Client),
 		unregister:  make(chan *Client),
+		revoke:      make(chan int),
+		revokeToken: make(chan int),
+		subscribe:   make(chan subscription),
+		unsubscribe: make(chan subscription),
+		join:        make(chan membership),
+		leave:       make(chan membership),
+		replay:      make(chan replayBatch),
+		typing:      make(chan typingEvent),
+		typists:     make(map[typingKey]*typist),
+		away:        make(chan awayEvent),
+		statuses:    make(map[int]string),
+		dirty:       make(map[int]bool),
+		presence:    make(chan presenceChange, 256),
 	}
 }
 
@@ -44,24 +227,95 @@ func (h *Hub) run() {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
-			if _, ok := h.chatClients[client.userID]; !ok {
-				h.chatClients[client.userID] = make(map[*Client]bool)
+			h.addClient(client)
+			for chatID := range client.chats {
+				h.addToRoom(client, chatID)
 			}
-			h.chatClients[client.userID][client] = true
 			h.mu.Unlock()
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if clients, ok := h.chatClients[client.userID]; ok {
-				delete(clients, client)
-				if len(clients) == 0 {
-					delete(h.chatClients, client.userID)
-				}
+			for chatID := range client.chats {
+				h.stopTyping(chatID, client.userID)
+			}
+			if _, ok := h.clients[client]; ok {
+				h.removeClient(client)
+				close(client.send)
 			}
 			h.mu.Unlock()
-			close(client.send)
 			client.conn.Close()
 
+		case sessionID := <-h.revoke:
+			h.mu.Lock()
+			for client := range h.clients {
+				if client.sessionID == sessionID {
+					h.dropClient(client)
+				}
+			}
+			h.mu.Unlock()
+
+		case tokenID := <-h.revokeToken:
+			h.mu.Lock()
+			for client := range h.clients {
+				if client.apiTokenID == tokenID {
+					h.dropClient(client)
+				}
+			}
+			h.mu.Unlock()
+
+		case sub := <-h.subscribe:
+			h.mu.Lock()
+			if _, ok := h.clients[sub.client]; ok {
+				sub.client.chats[sub.chatID] = true
+				h.addToRoom(sub.client, sub.chatID)
+			}
+			h.mu.Unlock()
+
+		case sub := <-h.unsubscribe:
+			h.mu.Lock()
+			delete(sub.client.chats, sub.chatID)
+			delete(sub.client.pending, sub.chatID)
+			h.removeFromRoom(sub.client, sub.chatID)
+			h.mu.Unlock()
+
+		case m := <-h.join:
+			h.mu.Lock()
+			for client := range h.userClients[m.userID] {
+				client.chats[m.chatID] = true
+				h.addToRoom(client, m.chatID)
+			}
+			h.mu.Unlock()
+
+		case m := <-h.leave:
+			h.mu.Lock()
+			h.stopTyping(m.chatID, m.userID)
+			for client := range h.userClients[m.userID] {
+				delete(client.chats, m.chatID)
+				delete(client.pending, m.chatID)
+				h.removeFromRoom(client, m.chatID)
+			}
+			h.mu.Unlock()
+
+		case batch := <-h.replay:
+			h.mu.Lock()
+			if _, ok := h.clients[batch.client]; ok {
+				h.flushReplay(batch)
+			}
+			h.mu.Unlock()
+
+		case ev := <-h.typing:
+			h.mu.Lock()
+			h.handleTyping(ev)
+			h.mu.Unlock()
+
+		case ev := <-h.away:
+			h.mu.Lock()
+			if _, ok := h.clients[ev.client]; ok {
+				ev.client.away = ev.away
+				h.dirty[ev.client.userID] = true
+			}
+			h.mu.Unlock()
+
 		case message := <-h.broadcast:
 			var msg Message
 			if err := json.Unmarshal(message, &msg); err != nil {
@@ -69,35 +323,387 @@ func (h *Hub) run() {
 				continue
 			}
 
-			h.mu.RLock()
-			clients, ok := h.chatClients[msg.ChatID]
-			if !ok {
-				h.mu.RUnlock()
-				continue
+			h.mu.Lock()
+			if msg.Type == "message" {
+				h.stopTyping(msg.ChatID, msg.UserID)
 			}
-			for client, _ := range clients {
-				if client.userID == msg.UserID {
+			for client := range h.chatClients[msg.ChatID] {
+				if held, ok := client.pending[msg.ChatID]; ok {
+					f := heldFrame{message: message}
+					if msg.Type == "message" || msg.Type == "system" {
+						f.id = msg.ID
+					}
+					client.pending[msg.ChatID] = append(held, f)
 					continue
 				}
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(clients, client)
-					client.conn.Close()
-				}
+				h.deliver(client, message)
+			}
+			h.mu.Unlock()
+		}
+
+		for _, change := range h.presenceChanges() {
+			h.presence <- change
+		}
+	}
+}
+
+// addToRoom and removeFromRoom must be called with h.mu held.
+func (h *Hub) addToRoom(client *Client, chatID int) {
+	if _, ok := h.chatClients[chatID]; !ok {
+		h.chatClients[chatID] = make(map[*Client]bool)
+	}
+	h.chatClients[chatID][client] = true
+}
+
+func (h *Hub) removeFromRoom(client *Client, chatID int) {
+	if clients, ok := h.chatClients[chatID]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(h.chatClients, chatID)
+		}
+	}
+}
+
+// addClient registers the client. It must be called with h.mu held.
+func (h *Hub) addClient(client *Client) {
+	h.clients[client] = true
+	if _, ok := h.userClients[client.userID]; !ok {
+		h.userClients[client.userID] = make(map[*Client]bool)
+	}
+	h.userClients[client.userID][client] = true
+	h.dirty[client.userID] = true
+}
+
+// dropClient closes the connection of a client whose credentials were
+// revoked, clearing its typing indicators. It must be called with h.mu held
+// for writing.
+func (h *Hub) dropClient(client *Client) {
+	for chatID := range client.chats {
+		h.stopTyping(chatID, client.userID)
+	}
+	h.removeClient(client)
+	close(client.send)
+}
+
+// removeClient drops the client from every room it is subscribed to. It must
+// be called with h.mu held.
+func (h *Hub) removeClient(client *Client) {
+	for chatID := range client.chats {
+		h.removeFromRoom(client, chatID)
+	}
+	delete(h.clients, client)
+	if clients, ok := h.userClients[client.userID]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(h.userClients, client.userID)
+		}
+	}
+	h.dirty[client.userID] = true
+}
+
+// deliver queues message on the client's send buffer. A client whose buffer is
+// full is dropped and its connection closed. It must be called with h.mu held
+// for writing.
+func (h *Hub) deliver(client *Client, message []byte) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	select {
+	case client.send <- message:
+	default:
+		h.removeClient(client)
+		close(client.send)
+		client.conn.Close()
+	}
+}
+
+// sendToChatUsers queues message on the connections of the given users that
+// are subscribed to the chat.
+func (h *Hub) sendToChatUsers(chatID int, userIDs []int, message []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, userID := range userIDs {
+		for client := range h.userClients[userID] {
+			if client.chats[chatID] {
+				h.deliver(client, message)
+			}
+		}
+	}
+}
+
+// handleTyping starts, refreshes or stops a typing indicator. Only the first
+// "typing_start" of a run is fanned out; later ones just push the expiry back.
+// It must be called with h.mu held for writing.
+func (h *Hub) handleTyping(ev typingEvent) {
+	key := typingKey{chatID: ev.chatID, userID: ev.userID}
+
+	if ev.expired != nil {
+		if h.typists[key] == ev.expired {
+			h.stopTyping(ev.chatID, ev.userID)
+		}
+		return
+	}
+
+	if _, ok := h.clients[ev.client]; !ok || !ev.client.chats[ev.chatID] {
+		return
+	}
+
+	if !ev.start {
+		h.stopTyping(ev.chatID, ev.userID)
+		return
+	}
+
+	old, typing := h.typists[key]
+	if typing {
+		old.timer.Stop()
+	}
+	t := &typist{}
+	t.timer = time.AfterFunc(typingTimeout, func() {
+		h.typing <- typingEvent{chatID: ev.chatID, userID: ev.userID, expired: t}
+	})
+	h.typists[key] = t
+
+	if !typing {
+		h.fanOutTyping("typing_start", ev.chatID, ev.userID)
+	}
+}
+
+// stopTyping clears the user's typing indicator in the chat, if any, and tells
+// the other subscribers. It must be called with h.mu held for writing.
+func (h *Hub) stopTyping(chatID, userID int) {
+	key := typingKey{chatID: chatID, userID: userID}
+	t, ok := h.typists[key]
+	if !ok {
+		return
+	}
+	t.timer.Stop()
+	delete(h.typists, key)
+	h.fanOutTyping("typing_stop", chatID, userID)
+}
+
+func (h *Hub) fanOutTyping(typ string, chatID, userID int) {
+	messageBytes, err := json.Marshal(Message{Type: typ, ChatID: chatID, UserID: userID})
+	if err != nil {
+		log.Printf("error marshaling message: %v", err)
+		return
+	}
+	for client := range h.chatClients[chatID] {
+		if client.userID == userID {
+			continue
+		}
+		h.deliver(client, messageBytes)
+	}
+}
+
+// flushReplay delivers a replay batch followed by the live frames held while
+// it was loaded, skipping any held message already contained in the batch. It
+// must be called with h.mu held for writing.
+func (h *Hub) flushReplay(batch replayBatch) {
+	client := batch.client
+	held, ok := client.pending[batch.chatID]
+	if !ok {
+		return
+	}
+	delete(client.pending, batch.chatID)
+
+	lastID := 0
+	for _, m := range batch.messages {
+		messageBytes, err := json.Marshal(newMessageFrame(m))
+		if err != nil {
+			log.Printf("error marshaling message: %v", err)
+			continue
+		}
+		h.deliver(client, messageBytes)
+		lastID = m.ID
+	}
+
+	if batch.truncated {
+		messageBytes, err := json.Marshal(Message{Type: "resume_truncated", ID: lastID, ChatID: batch.chatID})
+		if err != nil {
+			log.Printf("error marshaling message: %v", err)
+		} else {
+			h.deliver(client, messageBytes)
+		}
+	}
+
+	for _, f := range held {
+		if f.id != 0 && f.id <= lastID {
+			continue
+		}
+		h.deliver(client, f.message)
+	}
+}
+
+// reply queues a frame for this client only. It never blocks; the frame is
+// dropped if the send buffer is full or the client has been unregistered.
+func (c *Client) reply(msg Message) {
+	messageBytes, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("error marshaling message: %v", err)
+		return
+	}
+
+	c.hub.mu.RLock()
+	defer c.hub.mu.RUnlock()
+	if _, ok := c.hub.clients[c]; !ok {
+		return
+	}
+	select {
+	case c.send <- messageBytes:
+	default:
+	}
+}
+
+// allowed reports whether the client may send frames that need scope. It
+// replies with an "error" frame if not.
+func (c *Client) allowed(chatID int, scope string) bool {
+	if c.scopes == nil || slices.Contains(c.scopes, scope) {
+		return true
+	}
+	c.replyError(chatID, "the API token is not allowed to send this frame")
+	return false
+}
+
+func (c *Client) replyError(chatID int, content string) {
+	c.reply(Message{Type: "error", ChatID: chatID, Content: content})
+}
+
+// frameError returns the text of the "error" frame sent for err.
+func frameError(err error) string {
+	switch err {
+	case errChatNotFound:
+		return "chat not found"
+	case errNotParticipant:
+		return "not a participant of this chat"
+	case errForbidden:
+		return "not allowed"
+	case errMessageNotFound:
+		return "message not found"
+	case errMuted:
+		return "you are muted in this chat"
+	default:
+		return "internal server error"
+	}
+}
+
+// sendMessage stores a "message" frame, or runs the slash command it holds,
+// through the same path as the sendMessage handler. Messages are
+// acknowledged to the sender with an "ack" frame, commands with a "command"
+// frame carrying the reply, if any.
+func (c *Client) sendMessage(msg Message) {
+	form := createMessageForm{
+		Content: msg.Content,
+		ChatID:  msg.ChatID,
+	}
+	if msg.ParentID != nil {
+		form.ParentID = *msg.ParentID
+	}
+
+	result, err := c.app.submitMessage(&form, c.userID)
+	if err != nil {
+		reply := Message{Type: "error", ChatID: msg.ChatID, Nonce: msg.Nonce}
+		if err == errInvalidForm {
+			for field, message := range form.FieldErrors {
+				reply.Content = field + ": " + message
+				break
 			}
-			h.mu.RUnlock()
+		} else {
+			reply.Content = frameError(err)
+		}
+		c.reply(reply)
+		return
+	}
+
+	if result.command != "" {
+		reply := Message{Type: "command", ChatID: msg.ChatID, Content: result.reply, Nonce: msg.Nonce}
+		if result.message != nil {
+			reply.ID = result.message.ID
+		}
+		c.reply(reply)
+		return
+	}
+
+	message := result.message
+	c.reply(Message{
+		Type:    "ack",
+		ID:      message.ID,
+		ChatID:  message.ChatID,
+		UserID:  message.SenderID,
+		Created: &message.Created,
+		Nonce:   msg.Nonce,
+	})
+}
+
+// resume loads the messages the client missed in each chat of lastSeen, which
+// maps chat IDs to the last message ID the client saw, and hands them to the
+// hub. The chats must already be in c.pending.
+func (c *Client) resume(lastSeen map[int]int) {
+	for chatID, lastID := range lastSeen {
+		messages, err := c.app.messages.GetAfter(chatID, lastID, maxReplay+1)
+		if err != nil {
+			log.Printf("error loading messages to replay: %v", err)
+			c.replyError(chatID, "could not replay missed messages")
+			messages = nil
 		}
+		err = c.app.attachments.Load(messages)
+		if err != nil {
+			log.Printf("error loading attachments to replay: %v", err)
+		}
+
+		batch := replayBatch{client: c, chatID: chatID, messages: messages}
+		if len(messages) > maxReplay {
+			batch.messages = messages[:maxReplay]
+			batch.truncated = true
+		}
+		c.hub.replay <- batch
 	}
 }
 
+// release ends the holding of a client's live frames, after replaying what it
+// missed in the chats of lastSeen. It is called with the client's first
+// frame, or with nil after resumeWait, and reports whether it was the first
+// call for a holding client.
+func (c *Client) release(lastSeen map[int]int) bool {
+	if !c.holding {
+		return false
+	}
+	released := false
+	c.releaseOnce.Do(func() {
+		released = true
+		c.hub.mu.RLock()
+		var held []int
+		for chatID := range c.pending {
+			held = append(held, chatID)
+		}
+		c.hub.mu.RUnlock()
+
+		replay := make(map[int]int)
+		for _, chatID := range held {
+			if lastID, ok := lastSeen[chatID]; ok {
+				replay[chatID] = lastID
+				continue
+			}
+			c.hub.replay <- replayBatch{client: c, chatID: chatID}
+		}
+		go c.resume(replay)
+	})
+	return released
+}
+
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
 
+	cfg := c.app.wsConfig
+	c.conn.SetReadLimit(cfg.maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(cfg.pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(cfg.pongWait))
+		return nil
+	})
+
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
@@ -110,29 +716,87 @@ func (c *Client) readPump() {
 		var msg Message
 		if err := json.Unmarshal(message, &msg); err != nil {
 			log.Printf("error unmarshaling message: %v", err)
+			c.release(nil)
+			c.replyError(0, "malformed frame")
 			continue
 		}
 
 		msg.UserID = c.userID
 
-		messageBytes, err := json.Marshal(msg)
-		if err != nil {
-			log.Printf("error marshaling message: %v", err)
+		if msg.Type == "resume" {
+			if !c.release(msg.LastSeen) {
+				c.replyError(0, "resume must be the first frame")
+			}
 			continue
 		}
+		c.release(nil)
+
+		switch msg.Type {
+		case "subscribe":
+			if _, err := c.app.authorize(msg.ChatID, c.userID, permRead); err != nil {
+				c.replyError(msg.ChatID, frameError(err))
+				continue
+			}
+			c.hub.subscribe <- subscription{client: c, chatID: msg.ChatID}
+			c.reply(Message{Type: "subscribed", ChatID: msg.ChatID, UserID: c.userID})
+
+		case "unsubscribe":
+			c.hub.unsubscribe <- subscription{client: c, chatID: msg.ChatID}
+			c.reply(Message{Type: "unsubscribed", ChatID: msg.ChatID, UserID: c.userID})
 
-		c.hub.broadcast <- messageBytes
+		case "message":
+			if !c.allowed(msg.ChatID, scopeWrite) {
+				continue
+			}
+			c.sendMessage(msg)
+
+		case "read":
+			if !c.allowed(msg.ChatID, scopeWrite) {
+				continue
+			}
+			_, err := c.app.markRead(&readForm{ChatID: msg.ChatID, MessageID: msg.ID}, c.userID)
+			if err == errInvalidForm {
+				c.replyError(msg.ChatID, "id must be a message ID")
+			} else if err != nil {
+				c.replyError(msg.ChatID, frameError(err))
+			}
+
+		case "presence":
+			if msg.Status != statusOnline && msg.Status != statusAway {
+				c.replyError(0, "status must be online or away")
+				continue
+			}
+			c.hub.away <- awayEvent{client: c, away: msg.Status == statusAway}
+
+		case "typing_start", "typing_stop":
+			if !c.allowed(msg.ChatID, scopeWrite) {
+				continue
+			}
+			c.hub.typing <- typingEvent{
+				client: c,
+				chatID: msg.ChatID,
+				userID: c.userID,
+				start:  msg.Type == "typing_start",
+			}
+
+		default:
+			c.replyError(msg.ChatID, "unknown frame type")
+		}
 	}
 }
 
 func (c *Client) writePump() {
+	cfg := c.app.wsConfig
+	ticker := time.NewTicker(cfg.pingPeriod)
 	defer func() {
+		ticker.Stop()
 		c.conn.Close()
 	}()
 
 	for {
 		select {
 		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(cfg.writeWait))
 			if !ok {
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
@@ -153,6 +817,12 @@ func (c *Client) writePump() {
 			if err := w.Close(); err != nil {
 				return
 			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(cfg.writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
 		}
 	}
 }
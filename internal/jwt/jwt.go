@@ -12,43 +12,66 @@ var (
 	ErrExpiredToken = errors.New("token has expired")
 )
 
+// Claims are carried by access tokens. SessionID is the login the token was
+// issued for, so that it stops being accepted once the session is revoked.
 type Claims struct {
-	UserID int    `json:"user_id"`
-	Email  string `json:"email"`
+	UserID    int    `json:"user_id"`
+	Email     string `json:"email"`
+	SessionID int    `json:"sid"`
 	jwt.RegisteredClaims
 }
 
+// InviteClaims are carried by chat invite tokens. ExpiresAt is only set for
+// invites that expire.
+type InviteClaims struct {
+	InviteID int `json:"invite_id"`
+	ChatID   int `json:"chat_id"`
+	jwt.RegisteredClaims
+}
+
+// inviteAudience sets invite tokens apart from access tokens.
+const inviteAudience = "invite"
+
 type Manager struct {
-	secretKey []byte
+	keys *KeySet
+	ttl  time.Duration
 }
 
-func NewManager(secretKey string) *Manager {
+// NewManager returns a Manager signing and verifying tokens with keys and
+// issuing access tokens valid for ttl.
+func NewManager(keys *KeySet, ttl time.Duration) *Manager {
 	return &Manager{
-		secretKey: []byte(secretKey),
+		keys: keys,
+		ttl:  ttl,
 	}
 }
 
-func (m *Manager) GenerateToken(userID int, email string) (string, error) {
+// JWKS returns the public verification keys in JSON Web Key format.
+func (m *Manager) JWKS() []JWK {
+	return m.keys.JWKS()
+}
+
+// TTL returns how long access tokens are valid for.
+func (m *Manager) TTL() time.Duration {
+	return m.ttl
+}
+
+func (m *Manager) GenerateToken(userID int, email string, sessionID int) (string, error) {
 	claims := Claims{
-		UserID: userID,
-		Email:  email,
+		UserID:    userID,
+		Email:     email,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(m.ttl)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(m.secretKey)
+	return m.keys.sign(claims)
 }
 
 func (m *Manager) ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, ErrInvalidToken
-		}
-		return m.secretKey, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, m.keys.keyFunc)
 
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
@@ -58,6 +81,40 @@ func (m *Manager) ValidateToken(tokenString string) (*Claims, error) {
 	}
 
 	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid || claims.UserID == 0 || claims.SessionID == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+func (m *Manager) GenerateInviteToken(inviteID, chatID int, expires *time.Time) (string, error) {
+	claims := InviteClaims{
+		InviteID: inviteID,
+		ChatID:   chatID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience: jwt.ClaimStrings{inviteAudience},
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+	}
+	if expires != nil {
+		claims.ExpiresAt = jwt.NewNumericDate(*expires)
+	}
+
+	return m.keys.sign(claims)
+}
+
+func (m *Manager) ValidateInviteToken(tokenString string) (*InviteClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &InviteClaims{}, m.keys.keyFunc, jwt.WithAudience(inviteAudience))
+
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, ErrExpiredToken
+		}
+		return nil, ErrInvalidToken
+	}
+
+	claims, ok := token.Claims.(*InviteClaims)
 	if !ok || !token.Valid {
 		return nil, ErrInvalidToken
 	}
@@ -0,0 +1,173 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is a signing or verification key, named by the kid header of the
+// tokens it signs. Keys loaded from a public key file can only verify.
+type Key struct {
+	ID     string
+	method jwt.SigningMethod
+	sign   any
+	verify any
+}
+
+// CanSign reports whether the key holds the private part needed to sign.
+func (k *Key) CanSign() bool {
+	return k.sign != nil
+}
+
+// NewHMACKey returns an HS256 key for secret. HMAC keys are never published
+// in the JWKS.
+func NewHMACKey(id, secret string) *Key {
+	return &Key{ID: id, method: jwt.SigningMethodHS256, sign: []byte(secret), verify: []byte(secret)}
+}
+
+// LoadKeyFile reads a PEM encoded Ed25519 or RSA key. Private keys sign with
+// EdDSA or RS256 respectively; public keys are only used to verify tokens
+// signed before a rotation. The key ID is the file name without extension.
+func LoadKeyFile(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("jwt: %s: no PEM data", path)
+	}
+	id := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("jwt: %s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jwt: %s: %w", path, err)
+	}
+
+	key := &Key{ID: id}
+	switch k := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.method, key.sign, key.verify = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.method, key.verify = jwt.SigningMethodEdDSA, k
+	case *rsa.PrivateKey:
+		key.method, key.sign, key.verify = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.method, key.verify = jwt.SigningMethodRS256, k
+	default:
+		return nil, fmt.Errorf("jwt: %s: unsupported key type %T", path, parsed)
+	}
+	if pub, ok := key.verify.(*rsa.PublicKey); ok && pub.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("jwt: %s: RSA keys must be at least 2048 bits", path)
+	}
+	return key, nil
+}
+
+// KeySet holds the key new tokens are signed with and every key tokens are
+// accepted from. During a rotation the previous keys stay in the set until
+// the tokens they signed have expired.
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+	// legacy is the HMAC key, if any, used for tokens without a kid header,
+	// which were all signed with the HMAC secret.
+	legacy *Key
+}
+
+// NewKeySet returns a KeySet signing with signing and also accepting tokens
+// signed with any of verify.
+func NewKeySet(signing *Key, verify ...*Key) (*KeySet, error) {
+	if !signing.CanSign() {
+		return nil, fmt.Errorf("jwt: key %q cannot sign", signing.ID)
+	}
+	ks := &KeySet{signing: signing, keys: map[string]*Key{signing.ID: signing}}
+	for _, k := range verify {
+		if _, ok := ks.keys[k.ID]; ok {
+			return nil, fmt.Errorf("jwt: duplicate key ID %q", k.ID)
+		}
+		ks.keys[k.ID] = k
+	}
+	for _, k := range ks.keys {
+		if k.method == jwt.SigningMethodHS256 {
+			ks.legacy = k
+		}
+	}
+	return ks, nil
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.method, claims)
+	token.Header["kid"] = ks.signing.ID
+	return token.SignedString(ks.signing.sign)
+}
+
+// keyFunc picks the verification key named by the token's kid header and
+// checks that the token uses that key's algorithm, so that a public key can
+// never be used as an HMAC secret.
+func (ks *KeySet) keyFunc(token *jwt.Token) (any, error) {
+	key := ks.legacy
+	if kid, ok := token.Header["kid"]; ok {
+		id, _ := kid.(string)
+		key = ks.keys[id]
+	}
+	if key == nil || token.Method.Alg() != key.method.Alg() {
+		return nil, ErrInvalidToken
+	}
+	return key.verify, nil
+}
+
+// JWK is the public part of a key in JSON Web Key format.
+type JWK struct {
+	KeyType string `json:"kty"`
+	ID      string `json:"kid"`
+	Use     string `json:"use"`
+	Alg     string `json:"alg"`
+	Curve   string `json:"crv,omitempty"`
+	X       string `json:"x,omitempty"`
+	N       string `json:"n,omitempty"`
+	E       string `json:"e,omitempty"`
+}
+
+// JWKS returns the public keys of the set, so that other services can
+// verify tokens. HMAC keys are secret and left out.
+func (ks *KeySet) JWKS() []JWK {
+	enc := base64.RawURLEncoding
+	jwks := []JWK{}
+	for _, k := range ks.keys {
+		jwk := JWK{ID: k.ID, Use: "sig", Alg: k.method.Alg()}
+		switch pub := k.verify.(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType, jwk.Curve, jwk.X = "OKP", "Ed25519", enc.EncodeToString(pub)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = enc.EncodeToString(pub.N.Bytes())
+			jwk.E = enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		default:
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	sort.Slice(jwks, func(i, j int) bool { return jwks[i].ID < jwks[j].ID })
+	return jwks
+}
@@ -0,0 +1,318 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func marshalPKCS8(t *testing.T, key any) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func marshalPKIX(t *testing.T, key any) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		id      string
+		alg     string
+		canSign bool
+		err     string
+	}{
+		{
+			name:    "Ed25519 private key",
+			path:    writePEM(t, dir, "2024-06.pem", "PRIVATE KEY", marshalPKCS8(t, edPriv)),
+			id:      "2024-06",
+			alg:     "EdDSA",
+			canSign: true,
+		},
+		{
+			name: "Ed25519 public key",
+			path: writePEM(t, dir, "2024-01.pub", "PUBLIC KEY", marshalPKIX(t, edPub)),
+			id:   "2024-01",
+			alg:  "EdDSA",
+		},
+		{
+			name:    "RSA PKCS#1 private key",
+			path:    writePEM(t, dir, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)),
+			id:      "rsa",
+			alg:     "RS256",
+			canSign: true,
+		},
+		{
+			name:    "RSA PKCS#8 private key",
+			path:    writePEM(t, dir, "rsa8.pem", "PRIVATE KEY", marshalPKCS8(t, rsaKey)),
+			id:      "rsa8",
+			alg:     "RS256",
+			canSign: true,
+		},
+		{
+			name: "RSA public key",
+			path: writePEM(t, dir, "rsa.pub", "PUBLIC KEY", marshalPKIX(t, &rsaKey.PublicKey)),
+			id:   "rsa",
+			alg:  "RS256",
+		},
+		{
+			name: "Weak RSA key",
+			path: writePEM(t, dir, "weak.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(weakKey)),
+			err:  "at least 2048 bits",
+		},
+		{
+			name: "Unsupported PEM block",
+			path: writePEM(t, dir, "cert.pem", "CERTIFICATE", []byte{1, 2, 3}),
+			err:  "unsupported PEM block",
+		},
+		{
+			name: "Bad key data",
+			path: writePEM(t, dir, "bad.pem", "PRIVATE KEY", []byte{1, 2, 3}),
+			err:  "bad.pem",
+		},
+		{
+			name: "No PEM data",
+			path: garbage,
+			err:  "no PEM data",
+		},
+		{
+			name: "Missing file",
+			path: filepath.Join(dir, "missing.pem"),
+			err:  "no such file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := LoadKeyFile(tt.path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v; want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.ID != tt.id || key.method.Alg() != tt.alg || key.CanSign() != tt.canSign {
+				t.Errorf("got id %q, alg %s, can sign %t; want %q, %s, %t",
+					key.ID, key.method.Alg(), key.CanSign(), tt.id, tt.alg, tt.canSign)
+			}
+		})
+	}
+}
+
+func TestNewKeySet(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signing := &Key{ID: "a", method: jwt.SigningMethodEdDSA, sign: priv, verify: pub}
+	public := &Key{ID: "b", method: jwt.SigningMethodEdDSA, verify: pub}
+
+	tests := []struct {
+		name    string
+		signing *Key
+		verify  []*Key
+		err     string
+	}{
+		{name: "Signing key only", signing: signing},
+		{name: "With verification keys", signing: signing, verify: []*Key{public, NewHMACKey("hs256", "secret")}},
+		{name: "Public signing key", signing: public, err: `key "b" cannot sign`},
+		{name: "Duplicate key ID", signing: signing, verify: []*Key{{ID: "a", method: jwt.SigningMethodEdDSA, verify: pub}}, err: `duplicate key ID "a"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeySet(tt.signing, tt.verify...)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v; want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// signToken signs access token claims with key using method, with a kid
+// header unless kid is empty.
+func signToken(t *testing.T, method jwt.SigningMethod, key any, kid string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, Claims{
+		UserID:    1,
+		SessionID: 1,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestKeySetVerify(t *testing.T) {
+	curPub, curPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPub, oldPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := strings.Repeat("s", 32)
+
+	keys, err := NewKeySet(
+		&Key{ID: "cur", method: jwt.SigningMethodEdDSA, sign: curPriv, verify: curPub},
+		&Key{ID: "old", method: jwt.SigningMethodEdDSA, verify: oldPub},
+		&Key{ID: "rsa", method: jwt.SigningMethodRS256, verify: &rsaKey.PublicKey},
+		NewHMACKey("hs256", secret),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(keys, time.Hour)
+
+	issued, err := m.GenerateToken(1, "alice@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: marshalPKIX(t, &rsaKey.PublicKey)})
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{name: "Issued by the manager", token: issued, valid: true},
+		{name: "Signed with a previous key", token: signToken(t, jwt.SigningMethodEdDSA, oldPriv, "old"), valid: true},
+		{name: "Signed with RSA", token: signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa"), valid: true},
+		{name: "HMAC with kid", token: signToken(t, jwt.SigningMethodHS256, []byte(secret), "hs256"), valid: true},
+		{name: "Legacy HMAC without kid", token: signToken(t, jwt.SigningMethodHS256, []byte(secret), ""), valid: true},
+		{name: "Unknown kid", token: signToken(t, jwt.SigningMethodEdDSA, curPriv, "new")},
+		{name: "Kid of another key", token: signToken(t, jwt.SigningMethodEdDSA, oldPriv, "cur")},
+		{name: "Algorithm of another key", token: signToken(t, jwt.SigningMethodRS256, rsaKey, "cur")},
+		{name: "Ed25519 public key as HMAC secret", token: signToken(t, jwt.SigningMethodHS256, []byte(curPub), "cur")},
+		{name: "RSA public key as HMAC secret", token: signToken(t, jwt.SigningMethodHS256, rsaPEM, "rsa")},
+		{name: "Asymmetric token without kid", token: signToken(t, jwt.SigningMethodEdDSA, curPriv, "")},
+		{name: "Unsigned", token: signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "cur")},
+		{name: "Wrong HMAC secret", token: signToken(t, jwt.SigningMethodHS256, []byte("wrong"), "hs256")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.ValidateToken(tt.token)
+			if tt.valid && err != nil {
+				t.Errorf("got error %v; want a valid token", err)
+			}
+			if !tt.valid && err != ErrInvalidToken {
+				t.Errorf("got error %v; want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestKeySetWithoutHMAC(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeySet(&Key{ID: "cur", method: jwt.SigningMethodEdDSA, sign: priv, verify: pub})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens without a kid are only accepted from the HMAC secret.
+	token := signToken(t, jwt.SigningMethodHS256, []byte(pub), "")
+	_, err = NewManager(keys, time.Hour).ValidateToken(token)
+	if err != ErrInvalidToken {
+		t.Errorf("got error %v; want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeySet(
+		&Key{ID: "b", method: jwt.SigningMethodEdDSA, sign: priv, verify: pub},
+		&Key{ID: "a", method: jwt.SigningMethodRS256, verify: &rsaKey.PublicKey},
+		NewHMACKey("hs256", "secret"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := keys.JWKS()
+	if len(jwks) != 2 {
+		t.Fatalf("got %d keys; want 2 without the HMAC key", len(jwks))
+	}
+	if jwks[0].ID != "a" || jwks[0].KeyType != "RSA" || jwks[0].Alg != "RS256" || jwks[0].E != "AQAB" {
+		t.Errorf("got %+v; want the RSA key first", jwks[0])
+	}
+	if jwks[1].ID != "b" || jwks[1].KeyType != "OKP" || jwks[1].Curve != "Ed25519" || jwks[1].Alg != "EdDSA" {
+		t.Errorf("got %+v; want the Ed25519 key", jwks[1])
+	}
+}
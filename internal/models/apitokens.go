@@ -0,0 +1,131 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// APIToken is a long-lived credential acting as UserID, a person or a bot,
+// limited to Scopes. Only the hash of the token is stored, so the token
+// itself is shown once when created. Expires is nil for tokens that never
+// expire.
+type APIToken struct {
+	ID       int        `json:"id"`
+	UserID   int        `json:"user_id"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires"`
+	LastUsed *time.Time `json:"last_used"`
+}
+
+type APITokenModel struct {
+	DB *sql.DB
+}
+
+// apiTokenColumns is the column list read by scanAPIToken.
+const apiTokenColumns = `t.id, t.user_id, t.name, t.scopes, t.created, t.expires, t.last_used`
+
+// apiTokenActive restricts a query on api_tokens t to usable tokens.
+const apiTokenActive = `t.revoked_at IS NULL AND (t.expires IS NULL OR t.expires > UTC_TIMESTAMP())`
+
+func (m *APITokenModel) Insert(userID int, name, tokenHash string, scopes []string, expires *time.Time) (int, error) {
+	q := `INSERT INTO api_tokens (user_id, name, token_hash, scopes, created, expires)
+          VALUES (?, ?, ?, ?, UTC_TIMESTAMP(), ?)`
+	result, err := m.DB.Exec(q, userID, name, tokenHash, strings.Join(scopes, " "), expires)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// Get returns the token if it is still usable.
+func (m *APITokenModel) Get(id int) (*APIToken, error) {
+	q := `SELECT ` + apiTokenColumns + ` FROM api_tokens t WHERE t.id = ? AND ` + apiTokenActive
+	token, err := scanAPIToken(m.DB.QueryRow(q, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// GetByOwner returns the usable tokens of the user and of the bots the user
+// owns.
+func (m *APITokenModel) GetByOwner(userID int) ([]*APIToken, error) {
+	q := `SELECT ` + apiTokenColumns + ` FROM api_tokens t JOIN users u ON u.id = t.user_id
+          WHERE (u.id = ? OR u.owner_id = ?) AND ` + apiTokenActive + `
+          ORDER BY t.id`
+	rows, err := m.DB.Query(q, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*APIToken{}
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Authenticate returns the usable token with the hash and records that it
+// was used, at most once a minute. It returns ErrNoRecord for unknown,
+// expired and revoked tokens.
+func (m *APITokenModel) Authenticate(tokenHash string) (*APIToken, error) {
+	q := `SELECT ` + apiTokenColumns + ` FROM api_tokens t WHERE t.token_hash = ? AND ` + apiTokenActive
+	token, err := scanAPIToken(m.DB.QueryRow(q, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q = `UPDATE api_tokens SET last_used = UTC_TIMESTAMP()
+          WHERE id = ? AND (last_used IS NULL OR last_used < UTC_TIMESTAMP() - INTERVAL 1 MINUTE)`
+	_, err = m.DB.Exec(q, token.ID)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (m *APITokenModel) Revoke(id int) error {
+	q := `UPDATE api_tokens SET revoked_at = UTC_TIMESTAMP() WHERE id = ? AND revoked_at IS NULL`
+	_, err := m.DB.Exec(q, id)
+	return err
+}
+
+func scanAPIToken(row scanner) (*APIToken, error) {
+	var token APIToken
+	var scopes string
+	var expires, lastUsed sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &scopes, &token.Created, &expires, &lastUsed)
+	if err != nil {
+		return nil, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	if expires.Valid {
+		token.Expires = &expires.Time
+	}
+	if lastUsed.Valid {
+		token.LastUsed = &lastUsed.Time
+	}
+	return &token, nil
+}
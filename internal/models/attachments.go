@@ -0,0 +1,163 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Attachment is a file uploaded with a message. Its contents are kept in a
+// blob store under StorageKey and served from URL to the chat's members.
+type Attachment struct {
+	ID          int       `json:"id"`
+	MessageID   int       `json:"message_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	StorageKey  string    `json:"-"`
+	Created     time.Time `json:"created"`
+	URL         string    `json:"url"`
+	// ChatID and MessageDeleted come from the attachment's message and are
+	// only filled in by Get.
+	ChatID         int  `json:"-"`
+	MessageDeleted bool `json:"-"`
+}
+
+type AttachmentModel struct {
+	DB *sql.DB
+}
+
+const attachmentColumns = `a.id, a.message_id, a.filename, a.content_type, a.size, a.storage_key, a.created`
+
+func scanAttachment(row scanner, dest ...any) (*Attachment, error) {
+	var a Attachment
+	err := row.Scan(append([]any{&a.ID, &a.MessageID, &a.Filename, &a.ContentType, &a.Size, &a.StorageKey, &a.Created}, dest...)...)
+	if err != nil {
+		return nil, err
+	}
+	a.URL = fmt.Sprintf("/attachments/%d", a.ID)
+	return &a, nil
+}
+
+// Insert stores the attachments of the message with a single statement and
+// fills in their IDs.
+func (m *AttachmentModel) Insert(messageID int, attachments []*Attachment) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	args := make([]any, 0, 6*len(attachments))
+	for _, a := range attachments {
+		args = append(args, messageID, a.Filename, a.ContentType, a.Size, a.StorageKey, now)
+	}
+	q := `INSERT INTO attachments (message_id, filename, content_type, size, storage_key, created)
+          VALUES (?, ?, ?, ?, ?, ?)` + strings.Repeat(", (?, ?, ?, ?, ?, ?)", len(attachments)-1)
+	result, err := m.DB.Exec(q, args...)
+	if err != nil {
+		return err
+	}
+
+	// MySQL reports the ID of the first row of a multi-row insert; the rest
+	// are consecutive.
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for i, a := range attachments {
+		a.ID = int(id) + i
+		a.MessageID = messageID
+		a.Created = now
+		a.URL = fmt.Sprintf("/attachments/%d", a.ID)
+	}
+	return nil
+}
+
+func (m *AttachmentModel) Get(id int) (*Attachment, error) {
+	var chatID int
+	var deleted bool
+	q := `SELECT ` + attachmentColumns + `, m.chat_id, m.deleted_at IS NOT NULL FROM attachments a
+          JOIN messages m ON m.id = a.message_id
+          WHERE a.id = ?`
+	a, err := scanAttachment(m.DB.QueryRow(q, id), &chatID, &deleted)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.ChatID = chatID
+	a.MessageDeleted = deleted
+	return a, nil
+}
+
+// DeleteByMessageID removes the attachments of the message and returns the
+// storage keys of their blobs.
+func (m *AttachmentModel) DeleteByMessageID(messageID int) ([]string, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	q := `SELECT storage_key FROM attachments WHERE message_id = ? FOR UPDATE`
+	rows, err := tx.Query(q, messageID)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	q = `DELETE FROM attachments WHERE message_id = ?`
+	_, err = tx.Exec(q, messageID)
+	if err != nil {
+		return nil, err
+	}
+	return keys, tx.Commit()
+}
+
+// Load fills in the Attachments of the messages with a single query.
+func (m *AttachmentModel) Load(messages []*Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Message, len(messages))
+	args := make([]any, 0, len(messages))
+	for _, msg := range messages {
+		msg.Attachments = []*Attachment{}
+		byID[msg.ID] = msg
+		args = append(args, msg.ID)
+	}
+	q := `SELECT ` + attachmentColumns + ` FROM attachments a
+          WHERE a.message_id IN (?` + strings.Repeat(", ?", len(messages)-1) + `)
+          ORDER BY a.id`
+	rows, err := m.DB.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return err
+		}
+		if msg, ok := byID[a.MessageID]; ok {
+			msg.Attachments = append(msg.Attachments, a)
+		}
+	}
+	return rows.Err()
+}
@@ -2,14 +2,20 @@ package models
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"time"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 type Chat struct {
 	ID        int
 	Name      string
 	IsPrivate bool
-	Created   time.Time
+	// IsDirect marks one-to-one conversations created through GetOrCreateDirect.
+	IsDirect bool
+	Created  time.Time
 }
 
 type ChatModel struct {
@@ -30,6 +36,13 @@ func (m *ChatModel) Insert(name string, isPrivate bool) (int, error) {
 	return int(id), nil
 }
 
+// SetTopic replaces the topic of the chat; an empty topic clears it.
+func (m *ChatModel) SetTopic(id int, topic string) error {
+	q := `UPDATE chats SET topic = ? WHERE id = ?`
+	_, err := m.DB.Exec(q, topic, id)
+	return err
+}
+
 func (m *ChatModel) ExistsId(id int) (bool, error) {
 	var exists bool
 	q := `SELECT EXISTS(SELECT true FROM chats WHERE id = ?)`
@@ -59,3 +72,154 @@ func (m *ChatModel) IsPrivate(id int) (bool, error) {
 	}
 	return isPrivate, nil
 }
+
+// IsDirect reports whether the chat is a direct conversation.
+func (m *ChatModel) IsDirect(id int) (bool, error) {
+	var isDirect bool
+	q := `SELECT is_direct FROM chats WHERE id = ?`
+	err := m.DB.QueryRow(q, id).Scan(&isDirect)
+	if err != nil {
+		return false, err
+	}
+	return isDirect, nil
+}
+
+// ChatSummary describes a chat as listed for one of its participants. The Name
+// of a direct conversation is the other user's username. LastMessage and
+// LastMessageAt are nil for chats without messages.
+type ChatSummary struct {
+	ID            int        `json:"id"`
+	Name          string     `json:"name"`
+	Topic         string     `json:"topic"`
+	IsPrivate     bool       `json:"is_private"`
+	IsDirect      bool       `json:"is_direct"`
+	MemberCount   int        `json:"member_count"`
+	LastMessage   *string    `json:"last_message"`
+	LastMessageAt *time.Time `json:"last_message_at"`
+}
+
+// GetByUserID returns the chats the user takes part in, most recently active
+// first. The last message is the latest top-level message that is neither
+// deleted nor a system message, as counted by CountUnread. Chats without one
+// are ordered by their creation time.
+func (m *ChatModel) GetByUserID(userID int) ([]*ChatSummary, error) {
+	q := `SELECT c.id,
+          IF(c.is_direct, COALESCE((SELECT u.username FROM participants po JOIN users u ON u.id = po.user_id
+                                    WHERE po.chat_id = c.id AND po.user_id <> p.user_id LIMIT 1), ''), c.name),
+          c.topic, c.is_private, c.is_direct,
+          (SELECT COUNT(*) FROM participants pc WHERE pc.chat_id = c.id),
+          lm.content, lm.created
+          FROM participants p
+          JOIN chats c ON c.id = p.chat_id
+          LEFT JOIN messages lm ON lm.id = (SELECT MAX(m.id) FROM messages m
+                                              WHERE m.chat_id = c.id AND m.parent_id IS NULL
+                                              AND m.deleted_at IS NULL AND m.is_system = FALSE)
+          WHERE p.user_id = ?
+          ORDER BY COALESCE(lm.created, c.created) DESC, c.id DESC`
+	rows, err := m.DB.Query(q, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := []*ChatSummary{}
+	for rows.Next() {
+		var c ChatSummary
+		var content sql.NullString
+		var created sql.NullTime
+		err := rows.Scan(&c.ID, &c.Name, &c.Topic, &c.IsPrivate, &c.IsDirect, &c.MemberCount, &content, &created)
+		if err != nil {
+			return nil, err
+		}
+		if content.Valid {
+			c.LastMessage = &content.String
+		}
+		if created.Valid {
+			c.LastMessageAt = &created.Time
+		}
+		chats = append(chats, &c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return chats, nil
+}
+
+// GetOrCreateDirect returns the direct conversation between the two users,
+// creating it with both of them as members if it does not exist yet. created
+// reports whether a new chat was made. It returns ErrDirectNameTaken if a
+// group chat already has the name the conversation would get.
+func (m *ChatModel) GetOrCreateDirect(userID, otherID int) (id int, created bool, err error) {
+	key := directKey(userID, otherID)
+
+	id, err = m.getDirect(key)
+	if err != ErrNoRecord {
+		return id, false, err
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	// Direct chats are named after their key. DirectNamePrefix is reserved,
+	// so group chats created since cannot take these names.
+	q := `INSERT INTO chats (name, is_private, is_direct, direct_key, created) VALUES (?, TRUE, TRUE, ?, UTC_TIMESTAMP())`
+	result, err := tx.Exec(q, key, key)
+	if err != nil {
+		var mySQLError *mysql.MySQLError
+		if errors.As(err, &mySQLError) && mySQLError.Number == 1062 {
+			// Someone else created the conversation in the meantime, or an
+			// older group chat has its name.
+			id, err = m.getDirect(key)
+			if err == ErrNoRecord {
+				return 0, false, ErrDirectNameTaken
+			}
+			return id, false, err
+		}
+		return 0, false, err
+	}
+
+	chatID, err := result.LastInsertId()
+	if err != nil {
+		return 0, false, err
+	}
+
+	q = `INSERT INTO participants (chat_id, user_id, role, created) VALUES (?, ?, ?, UTC_TIMESTAMP()), (?, ?, ?, UTC_TIMESTAMP())`
+	_, err = tx.Exec(q, chatID, userID, RoleMember, chatID, otherID, RoleMember)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return int(chatID), true, nil
+}
+
+func (m *ChatModel) getDirect(key string) (int, error) {
+	var id int
+	q := `SELECT id FROM chats WHERE direct_key = ?`
+	err := m.DB.QueryRow(q, key).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrNoRecord
+	}
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// DirectNamePrefix starts the names of direct conversations. Group chats
+// cannot be given names with it.
+const DirectNamePrefix = "dm:"
+
+// directKey identifies the direct conversation between two users regardless
+// of which of them started it.
+func directKey(a, b int) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%s%d:%d", DirectNamePrefix, a, b)
+}
@@ -9,4 +9,8 @@ var (
 	ErrInvalidCredentials = errors.New("models: invalid credentials")
 	ErrDuplicateEmail     = errors.New("models: duplicate email")
 	ErrDuplicateUsername  = errors.New("models: duplicate username")
+	ErrInviteUnusable     = errors.New("models: invite revoked, expired or used up")
+	ErrAlreadyParticipant = errors.New("models: already a participant")
+	ErrTokenReused        = errors.New("models: refresh token reused")
+	ErrDirectNameTaken    = errors.New("models: direct chat name taken by another chat")
 )
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Invite lets users join a chat, including private ones. Expires and MaxUses
+// are nil for invites that never expire or have no use limit.
+type Invite struct {
+	ID        int
+	ChatID    int
+	CreatedBy int
+	Expires   *time.Time
+	MaxUses   *int
+	Uses      int
+	Revoked   bool
+	Created   time.Time
+}
+
+type InviteModel struct {
+	DB *sql.DB
+}
+
+func (m *InviteModel) Insert(chatID, createdBy int, expires *time.Time, maxUses *int) (int, error) {
+	q := `INSERT INTO invites (chat_id, created_by, expires, max_uses, uses, revoked, created)
+          VALUES (?, ?, ?, ?, 0, FALSE, UTC_TIMESTAMP())`
+	result, err := m.DB.Exec(q, chatID, createdBy, expires, maxUses)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+func (m *InviteModel) Get(id int) (*Invite, error) {
+	q := `SELECT id, chat_id, created_by, expires, max_uses, uses, revoked, created FROM invites WHERE id = ?`
+	inv, err := scanInvite(m.DB.QueryRow(q, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// GetActiveByChatID returns the chat's invites that can still be used.
+func (m *InviteModel) GetActiveByChatID(chatID int) ([]*Invite, error) {
+	q := `SELECT id, chat_id, created_by, expires, max_uses, uses, revoked, created FROM invites
+          WHERE chat_id = ? AND revoked = FALSE
+          AND (expires IS NULL OR expires > UTC_TIMESTAMP())
+          AND (max_uses IS NULL OR uses < max_uses)
+          ORDER BY id DESC`
+	rows, err := m.DB.Query(q, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []*Invite{}
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, inv)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func (m *InviteModel) Revoke(id int) error {
+	q := `UPDATE invites SET revoked = TRUE WHERE id = ?`
+	_, err := m.DB.Exec(q, id)
+	return err
+}
+
+// Accept uses up one use of the invite and adds the user to its chat as a
+// member. It returns ErrInviteUnusable if the invite is revoked, expired or
+// used up, and ErrAlreadyParticipant if the user is already in the chat, in
+// which case the use is not counted.
+func (m *InviteModel) Accept(id, userID int) (chatID int, err error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	q := `SELECT id, chat_id, created_by, expires, max_uses, uses, revoked, created FROM invites
+          WHERE id = ? FOR UPDATE`
+	inv, err := scanInvite(tx.QueryRow(q, id))
+	if err == sql.ErrNoRows {
+		return 0, ErrNoRecord
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if inv.Revoked ||
+		(inv.Expires != nil && !inv.Expires.After(time.Now())) ||
+		(inv.MaxUses != nil && inv.Uses >= *inv.MaxUses) {
+		return 0, ErrInviteUnusable
+	}
+
+	var exists bool
+	q = `SELECT EXISTS(SELECT true FROM participants WHERE chat_id = ? AND user_id = ?)`
+	err = tx.QueryRow(q, inv.ChatID, userID).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return inv.ChatID, ErrAlreadyParticipant
+	}
+
+	q = `INSERT INTO participants (chat_id, user_id, role, created) VALUES (?, ?, ?, UTC_TIMESTAMP())`
+	_, err = tx.Exec(q, inv.ChatID, userID, RoleMember)
+	if err != nil {
+		return 0, err
+	}
+
+	q = `UPDATE invites SET uses = uses + 1 WHERE id = ?`
+	_, err = tx.Exec(q, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return inv.ChatID, nil
+}
+
+func scanInvite(row scanner) (*Invite, error) {
+	var inv Invite
+	var expires sql.NullTime
+	var maxUses sql.NullInt64
+	err := row.Scan(&inv.ID, &inv.ChatID, &inv.CreatedBy, &expires, &maxUses, &inv.Uses, &inv.Revoked, &inv.Created)
+	if err != nil {
+		return nil, err
+	}
+	if expires.Valid {
+		inv.Expires = &expires.Time
+	}
+	if maxUses.Valid {
+		n := int(maxUses.Int64)
+		inv.MaxUses = &n
+	}
+	return &inv, nil
+}
@@ -2,24 +2,112 @@ package models
 
 import (
 	"database/sql"
+	"math"
+	"strings"
 	"time"
 )
 
 type Message struct {
-	ID       int
-	ChatID   int
-	SenderID int
-	Content  string
-	Created  time.Time
+	ID       int    `json:"id"`
+	ChatID   int    `json:"chat_id"`
+	SenderID int    `json:"sender_id"`
+	Content  string `json:"content"`
+	// IsSystem marks messages generated by the server, such as a member
+	// leaving. SenderID is then the user the message is about.
+	IsSystem bool `json:"is_system"`
+	// IsBot marks messages posted by a bot user.
+	IsBot   bool      `json:"is_bot"`
+	Created time.Time `json:"created"`
+	// EditedAt is set once the message has been edited, and Deleted once it
+	// has been deleted. Deleted messages are kept as tombstones with no
+	// content.
+	EditedAt *time.Time `json:"edited_at"`
+	Deleted  bool       `json:"deleted"`
+	// ParentID is the message this one replies to in a thread, or nil for
+	// top-level messages. ReplyCount and LastReplyAt describe the thread of
+	// a top-level message; they are only filled in by LoadReplyStats.
+	ParentID    *int       `json:"parent_id"`
+	ReplyCount  int        `json:"reply_count"`
+	LastReplyAt *time.Time `json:"last_reply_at"`
+	// Reactions is only filled in by ReactionModel.Load.
+	Reactions []*ReactionSummary `json:"reactions"`
+	// Attachments is only filled in by AttachmentModel.Load.
+	Attachments []*Attachment `json:"attachments"`
+}
+
+// MessageEdit is an earlier version of an edited message.
+type MessageEdit struct {
+	ID        int       `json:"id"`
+	MessageID int       `json:"message_id"`
+	Content   string    `json:"content"`
+	Created   time.Time `json:"created"`
 }
 
 type MessageModel struct {
 	DB *sql.DB
 }
 
+// messageColumns is the column list read by scanMessage.
+const messageColumns = `id, chat_id, sender_id, content, is_system, is_bot, created, edited_at, deleted_at IS NOT NULL, parent_id`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMessage(row scanner) (*Message, error) {
+	var msg Message
+	var editedAt sql.NullTime
+	var parentID sql.NullInt64
+	err := row.Scan(&msg.ID, &msg.ChatID, &msg.SenderID, &msg.Content, &msg.IsSystem, &msg.IsBot, &msg.Created, &editedAt, &msg.Deleted, &parentID)
+	if err != nil {
+		return nil, err
+	}
+	if editedAt.Valid {
+		msg.EditedAt = &editedAt.Time
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		msg.ParentID = &id
+	}
+	return &msg, nil
+}
+
+// Insert stores a message, flagged as a bot message if the sender is a bot.
 func (m *MessageModel) Insert(chatID, senderID int, content string) (int, error) {
-	q := `INSERT INTO messages (chat_id, sender_id, content, created) VALUES (?, ?, ?, UTC_TIMESTAMP())`
-	result, err := m.DB.Exec(q, chatID, senderID, content)
+	q := `INSERT INTO messages (chat_id, sender_id, content, is_bot, created)
+          SELECT ?, id, ?, is_bot, UTC_TIMESTAMP() FROM users WHERE id = ?`
+	result, err := m.DB.Exec(q, chatID, content, senderID)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// InsertReply stores a reply to parentID in the chat's thread of that message.
+func (m *MessageModel) InsertReply(chatID, senderID, parentID int, content string) (int, error) {
+	q := `INSERT INTO messages (chat_id, sender_id, content, parent_id, is_bot, created)
+          SELECT ?, id, ?, ?, is_bot, UTC_TIMESTAMP() FROM users WHERE id = ?`
+	result, err := m.DB.Exec(q, chatID, content, parentID, senderID)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// InsertSystem stores a system message about the user in the chat.
+func (m *MessageModel) InsertSystem(chatID, userID int, content string) (int, error) {
+	q := `INSERT INTO messages (chat_id, sender_id, content, is_system, created) VALUES (?, ?, ?, TRUE, UTC_TIMESTAMP())`
+	result, err := m.DB.Exec(q, chatID, userID, content)
 	if err != nil {
 		return 0, err
 	}
@@ -31,9 +119,195 @@ func (m *MessageModel) Insert(chatID, senderID int, content string) (int, error)
 	return int(id), nil
 }
 
-func (m *MessageModel) GetByChatID(chatID int) ([]*Message, error) {
-	q := `SELECT id, chat_id, sender_id, content, created FROM messages WHERE chat_id = ? ORDER BY created ASC`
-	rows, err := m.DB.Query(q, chatID)
+func (m *MessageModel) Get(id int) (*Message, error) {
+	q := `SELECT ` + messageColumns + ` FROM messages WHERE id = ?`
+	msg, err := scanMessage(m.DB.QueryRow(q, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Update replaces the content of the message and records the previous
+// content in its edit history.
+func (m *MessageModel) Update(id int, content string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `INSERT INTO message_edits (message_id, content, created)
+          SELECT id, content, COALESCE(edited_at, created) FROM messages WHERE id = ? AND deleted_at IS NULL`
+	result, err := tx.Exec(q, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+
+	q = `UPDATE messages SET content = ?, edited_at = UTC_TIMESTAMP() WHERE id = ?`
+	_, err = tx.Exec(q, content, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete turns the message into a tombstone, dropping its content and edit
+// history.
+func (m *MessageModel) Delete(id int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `UPDATE messages SET content = '', deleted_at = UTC_TIMESTAMP() WHERE id = ? AND deleted_at IS NULL`
+	result, err := tx.Exec(q, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+
+	q = `DELETE FROM message_edits WHERE message_id = ?`
+	_, err = tx.Exec(q, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetEdits returns the earlier versions of the message, oldest first.
+func (m *MessageModel) GetEdits(id int) ([]*MessageEdit, error) {
+	q := `SELECT id, message_id, content, created FROM message_edits WHERE message_id = ? ORDER BY id ASC`
+	rows, err := m.DB.Query(q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []*MessageEdit{}
+	for rows.Next() {
+		var e MessageEdit
+		err := rows.Scan(&e.ID, &e.MessageID, &e.Content, &e.Created)
+		if err != nil {
+			return nil, err
+		}
+		edits = append(edits, &e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return edits, nil
+}
+
+// GetBefore returns up to limit of the most recent top-level messages in the
+// chat with an ID lower than beforeID, oldest first. A beforeID of 0 means no
+// upper bound. It relies on the (chat_id, id) index on messages.
+func (m *MessageModel) GetBefore(chatID, beforeID, limit int) ([]*Message, error) {
+	if beforeID == 0 {
+		beforeID = math.MaxInt
+	}
+	q := `SELECT ` + messageColumns + ` FROM messages
+          WHERE chat_id = ? AND id < ? AND parent_id IS NULL ORDER BY id DESC LIMIT ?`
+	messages, err := m.query(q, chatID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	reverse(messages)
+	return messages, nil
+}
+
+// GetAfter returns up to limit of the top-level messages in the chat with an
+// ID higher than afterID, oldest first.
+func (m *MessageModel) GetAfter(chatID, afterID, limit int) ([]*Message, error) {
+	q := `SELECT ` + messageColumns + ` FROM messages
+          WHERE chat_id = ? AND id > ? AND parent_id IS NULL ORDER BY id ASC LIMIT ?`
+	return m.query(q, chatID, afterID, limit)
+}
+
+// GetRepliesBefore is GetBefore for the thread of parentID. It relies on the
+// (parent_id, id) index on messages.
+func (m *MessageModel) GetRepliesBefore(parentID, beforeID, limit int) ([]*Message, error) {
+	if beforeID == 0 {
+		beforeID = math.MaxInt
+	}
+	q := `SELECT ` + messageColumns + ` FROM messages
+          WHERE parent_id = ? AND id < ? ORDER BY id DESC LIMIT ?`
+	messages, err := m.query(q, parentID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	reverse(messages)
+	return messages, nil
+}
+
+// GetRepliesAfter is GetAfter for the thread of parentID.
+func (m *MessageModel) GetRepliesAfter(parentID, afterID, limit int) ([]*Message, error) {
+	q := `SELECT ` + messageColumns + ` FROM messages
+          WHERE parent_id = ? AND id > ? ORDER BY id ASC LIMIT ?`
+	return m.query(q, parentID, afterID, limit)
+}
+
+// LoadReplyStats fills in ReplyCount and LastReplyAt of the messages with a
+// single grouped query.
+func (m *MessageModel) LoadReplyStats(messages []*Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Message, len(messages))
+	args := make([]any, 0, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
+		args = append(args, msg.ID)
+	}
+	q := `SELECT parent_id, COUNT(*), MAX(created) FROM messages
+          WHERE deleted_at IS NULL AND parent_id IN (?` + strings.Repeat(", ?", len(args)-1) + `)
+          GROUP BY parent_id`
+	rows, err := m.DB.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var parentID, count int
+		var last time.Time
+		if err := rows.Scan(&parentID, &count, &last); err != nil {
+			return err
+		}
+		if msg, ok := byID[parentID]; ok {
+			msg.ReplyCount = count
+			msg.LastReplyAt = &last
+		}
+	}
+	return rows.Err()
+}
+
+func reverse(messages []*Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
+
+func (m *MessageModel) query(q string, args ...any) ([]*Message, error) {
+	rows, err := m.DB.Query(q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -41,15 +315,51 @@ func (m *MessageModel) GetByChatID(chatID int) ([]*Message, error) {
 
 	messages := []*Message{}
 	for rows.Next() {
-		var msg Message
-		err := rows.Scan(&msg.ID, &msg.ChatID, &msg.SenderID, &msg.Content, &msg.Created)
+		msg, err := scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
-		messages = append(messages, &msg)
+		messages = append(messages, msg)
 	}
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 	return messages, nil
 }
+
+type UnreadCount struct {
+	ChatID            int `json:"chat_id"`
+	LastReadMessageID int `json:"last_read_message_id"`
+	Unread            int `json:"unread"`
+}
+
+// CountUnread returns, for every chat the user takes part in, the number of
+// top-level messages sent by others after the user's read marker, leaving out
+// deleted and system messages. The count is a range scan on the
+// (chat_id, id) index of messages.
+func (m *MessageModel) CountUnread(userID int) ([]*UnreadCount, error) {
+	q := `SELECT p.chat_id, p.last_read_message_id, COUNT(m.id) FROM participants p
+          LEFT JOIN messages m ON m.chat_id = p.chat_id AND m.id > p.last_read_message_id AND m.sender_id <> p.user_id
+          AND m.parent_id IS NULL AND m.deleted_at IS NULL AND m.is_system = FALSE
+          WHERE p.user_id = ?
+          GROUP BY p.chat_id, p.last_read_message_id`
+	rows, err := m.DB.Query(q, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []*UnreadCount{}
+	for rows.Next() {
+		var c UnreadCount
+		err := rows.Scan(&c.ChatID, &c.LastReadMessageID, &c.Unread)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, &c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
@@ -5,10 +5,18 @@ import (
 	"time"
 )
 
+// Participant roles.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
 type Participant struct {
 	ID      int
 	ChatID  int
 	UserID  int
+	Role    string
 	Created time.Time
 }
 
@@ -16,9 +24,9 @@ type ParticipantModel struct {
 	DB *sql.DB
 }
 
-func (m *ParticipantModel) Insert(chatID, userID int) (int, error) {
-	q := `INSERT INTO participants (chat_id, user_id, created) VALUES (?, ?, UTC_TIMESTAMP())`
-	result, err := m.DB.Exec(q, chatID, userID)
+func (m *ParticipantModel) Insert(chatID, userID int, role string) (int, error) {
+	q := `INSERT INTO participants (chat_id, user_id, role, created) VALUES (?, ?, ?, UTC_TIMESTAMP())`
+	result, err := m.DB.Exec(q, chatID, userID, role)
 	if err != nil {
 		return 0, err
 	}
@@ -31,7 +39,7 @@ func (m *ParticipantModel) Insert(chatID, userID int) (int, error) {
 }
 
 func (m *ParticipantModel) GetByChatID(chatID int) ([]*Participant, error) {
-	q := `SELECT id, chat_id, user_id, created FROM participants WHERE chat_id = ?`
+	q := `SELECT id, chat_id, user_id, role, created FROM participants WHERE chat_id = ?`
 	rows, err := m.DB.Query(q, chatID)
 	if err != nil {
 		return nil, err
@@ -41,7 +49,7 @@ func (m *ParticipantModel) GetByChatID(chatID int) ([]*Participant, error) {
 	participants := []*Participant{}
 	for rows.Next() {
 		var p Participant
-		err := rows.Scan(&p.ID, &p.ChatID, &p.UserID, &p.Created)
+		err := rows.Scan(&p.ID, &p.ChatID, &p.UserID, &p.Role, &p.Created)
 		if err != nil {
 			return nil, err
 		}
@@ -54,7 +62,7 @@ func (m *ParticipantModel) GetByChatID(chatID int) ([]*Participant, error) {
 }
 
 func (m *ParticipantModel) GetByUserID(userID int) ([]*Participant, error) {
-	stmt := `SELECT id, chat_id, user_id, created FROM participants WHERE user_id = ?`
+	stmt := `SELECT id, chat_id, user_id, role, created FROM participants WHERE user_id = ?`
 	rows, err := m.DB.Query(stmt, userID)
 	if err != nil {
 		return nil, err
@@ -64,7 +72,7 @@ func (m *ParticipantModel) GetByUserID(userID int) ([]*Participant, error) {
 	participants := []*Participant{}
 	for rows.Next() {
 		var p Participant
-		err := rows.Scan(&p.ID, &p.ChatID, &p.UserID, &p.Created)
+		err := rows.Scan(&p.ID, &p.ChatID, &p.UserID, &p.Role, &p.Created)
 		if err != nil {
 			return nil, err
 		}
@@ -75,3 +83,183 @@ func (m *ParticipantModel) GetByUserID(userID int) ([]*Participant, error) {
 	}
 	return participants, nil
 }
+
+func (m *ParticipantModel) Exists(chatID, userID int) (bool, error) {
+	var exists bool
+	q := `SELECT EXISTS(SELECT true FROM participants WHERE chat_id = ? AND user_id = ?)`
+	err := m.DB.QueryRow(q, chatID, userID).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// GetContactIDs returns the IDs of the other users who share at least one
+// chat with the user.
+func (m *ParticipantModel) GetContactIDs(userID int) ([]int, error) {
+	q := `SELECT DISTINCT p2.user_id FROM participants p1
+          JOIN participants p2 ON p2.chat_id = p1.chat_id
+          WHERE p1.user_id = ? AND p2.user_id <> ?`
+	rows, err := m.DB.Query(q, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// UpdateLastRead moves the participant's read marker forward to messageID. It
+// reports false if the marker was already at or past it.
+func (m *ParticipantModel) UpdateLastRead(chatID, userID, messageID int) (bool, error) {
+	q := `UPDATE participants SET last_read_message_id = ?
+          WHERE chat_id = ? AND user_id = ? AND last_read_message_id < ?`
+	result, err := m.DB.Exec(q, messageID, chatID, userID, messageID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetRole returns the user's role in the chat, or ErrNoRecord if the user is
+// not a participant.
+func (m *ParticipantModel) GetRole(chatID, userID int) (string, error) {
+	var role string
+	q := `SELECT role FROM participants WHERE chat_id = ? AND user_id = ?`
+	err := m.DB.QueryRow(q, chatID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNoRecord
+	}
+	if err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+// SetMutedUntil keeps the user from posting in the chat until the given
+// time, or unmutes them if until is nil. It returns ErrNoRecord if the user
+// is not a participant.
+func (m *ParticipantModel) SetMutedUntil(chatID, userID int, until *time.Time) error {
+	q := `UPDATE participants SET muted_until = ? WHERE chat_id = ? AND user_id = ?`
+	_, err := m.DB.Exec(q, until, chatID, userID)
+	if err != nil {
+		return err
+	}
+
+	exists, err := m.Exists(chatID, userID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// MutedUntil returns when the user's mute in the chat ends, or nil if the
+// user is not muted.
+func (m *ParticipantModel) MutedUntil(chatID, userID int) (*time.Time, error) {
+	var until sql.NullTime
+	q := `SELECT muted_until FROM participants
+          WHERE chat_id = ? AND user_id = ? AND muted_until > UTC_TIMESTAMP()`
+	err := m.DB.QueryRow(q, chatID, userID).Scan(&until)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !until.Valid {
+		return nil, nil
+	}
+	return &until.Time, nil
+}
+
+// Delete removes the user from the chat. It returns ErrNoRecord if the user
+// was not a participant.
+func (m *ParticipantModel) Delete(chatID, userID int) error {
+	q := `DELETE FROM participants WHERE chat_id = ? AND user_id = ?`
+	result, err := m.DB.Exec(q, chatID, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// UpdateRole sets the user's role in the chat. It returns ErrNoRecord if the
+// user is not a participant.
+func (m *ParticipantModel) UpdateRole(chatID, userID int, role string) error {
+	q := `UPDATE participants SET role = ? WHERE chat_id = ? AND user_id = ?`
+	result, err := m.DB.Exec(q, role, chatID, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		exists, err := m.Exists(chatID, userID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNoRecord
+		}
+	}
+	return nil
+}
+
+// TransferOwnership makes toID the owner of the chat and demotes the current
+// owner fromID to admin. It returns ErrNoRecord if toID is not a participant.
+func (m *ParticipantModel) TransferOwnership(chatID, fromID, toID int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `UPDATE participants SET role = ? WHERE chat_id = ? AND user_id = ?`
+	result, err := tx.Exec(q, RoleOwner, chatID, toID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+
+	_, err = tx.Exec(q, RoleAdmin, chatID, fromID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
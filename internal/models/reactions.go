@@ -0,0 +1,98 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// ReactionSummary aggregates the reactions to a message with one emoji.
+// Reacted reports whether the user the summary was loaded for is among them.
+type ReactionSummary struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+type ReactionModel struct {
+	DB *sql.DB
+}
+
+// Add records the user's reaction to the message. It reports false if the
+// user had already reacted with that emoji.
+func (m *ReactionModel) Add(messageID, userID int, emoji string) (bool, error) {
+	q := `INSERT IGNORE INTO reactions (message_id, user_id, emoji, created) VALUES (?, ?, ?, UTC_TIMESTAMP())`
+	result, err := m.DB.Exec(q, messageID, userID, emoji)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Remove deletes the user's reaction to the message. It reports false if
+// there was no such reaction.
+func (m *ReactionModel) Remove(messageID, userID int, emoji string) (bool, error) {
+	q := `DELETE FROM reactions WHERE message_id = ? AND user_id = ? AND emoji = ?`
+	result, err := m.DB.Exec(q, messageID, userID, emoji)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Count returns how many users reacted to the message with the emoji.
+func (m *ReactionModel) Count(messageID int, emoji string) (int, error) {
+	var count int
+	q := `SELECT COUNT(*) FROM reactions WHERE message_id = ? AND emoji = ?`
+	err := m.DB.QueryRow(q, messageID, emoji).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Load fills in the Reactions of the messages as seen by the user, with a
+// single grouped query. Emojis are listed in the order they were first used.
+func (m *ReactionModel) Load(messages []*Message, userID int) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Message, len(messages))
+	args := []any{userID}
+	for _, msg := range messages {
+		msg.Reactions = []*ReactionSummary{}
+		byID[msg.ID] = msg
+		args = append(args, msg.ID)
+	}
+	q := `SELECT message_id, emoji, COUNT(*), MAX(user_id = ?) FROM reactions
+          WHERE message_id IN (?` + strings.Repeat(", ?", len(messages)-1) + `)
+          GROUP BY message_id, emoji
+          ORDER BY message_id, MIN(created), emoji`
+	rows, err := m.DB.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID int
+		var r ReactionSummary
+		if err := rows.Scan(&messageID, &r.Emoji, &r.Count, &r.Reacted); err != nil {
+			return err
+		}
+		if msg, ok := byID[messageID]; ok {
+			msg.Reactions = append(msg.Reactions, &r)
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SessionModel stores logins and their refresh tokens. Refresh tokens are
+// identified by their hash and each can be used once; presenting a used one
+// again revokes the whole session, as it means the token was stolen.
+type SessionModel struct {
+	DB *sql.DB
+}
+
+// Insert starts a session for the user with its first refresh token.
+func (m *SessionModel) Insert(userID int, tokenHash string, expires time.Time) (int, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	q := `INSERT INTO sessions (user_id, created) VALUES (?, UTC_TIMESTAMP())`
+	result, err := tx.Exec(q, userID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	q = `INSERT INTO refresh_tokens (session_id, token_hash, created, expires) VALUES (?, ?, UTC_TIMESTAMP(), ?)`
+	_, err = tx.Exec(q, id, tokenHash, expires)
+	if err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// Rotate exchanges the refresh token with hash oldHash for a new one in the
+// same session and returns the session and its user. It returns ErrNoRecord
+// for unknown or expired tokens and tokens of revoked sessions, and
+// ErrTokenReused, after revoking the session, for tokens already rotated.
+func (m *SessionModel) Rotate(oldHash, newHash string, expires time.Time) (sessionID, userID int, err error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var tokenID int
+	var expired, used, revoked bool
+	q := `SELECT t.id, t.session_id, s.user_id, t.expires <= UTC_TIMESTAMP(), t.used_at IS NOT NULL, s.revoked_at IS NOT NULL
+          FROM refresh_tokens t JOIN sessions s ON s.id = t.session_id
+          WHERE t.token_hash = ? FOR UPDATE`
+	err = tx.QueryRow(q, oldHash).Scan(&tokenID, &sessionID, &userID, &expired, &used, &revoked)
+	if err == sql.ErrNoRows {
+		return 0, 0, ErrNoRecord
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch {
+	case revoked:
+		return 0, 0, ErrNoRecord
+	case used:
+		q = `UPDATE sessions SET revoked_at = UTC_TIMESTAMP() WHERE id = ?`
+		_, err = tx.Exec(q, sessionID)
+		if err != nil {
+			return 0, 0, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return 0, 0, err
+		}
+		return sessionID, userID, ErrTokenReused
+	case expired:
+		return 0, 0, ErrNoRecord
+	}
+
+	q = `UPDATE refresh_tokens SET used_at = UTC_TIMESTAMP() WHERE id = ?`
+	_, err = tx.Exec(q, tokenID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	q = `INSERT INTO refresh_tokens (session_id, token_hash, created, expires) VALUES (?, ?, UTC_TIMESTAMP(), ?)`
+	_, err = tx.Exec(q, sessionID, newHash, expires)
+	if err != nil {
+		return 0, 0, err
+	}
+	return sessionID, userID, tx.Commit()
+}
+
+// GetIDByToken returns the session of the refresh token with the hash,
+// whether or not it has been used.
+func (m *SessionModel) GetIDByToken(tokenHash string) (int, error) {
+	var id int
+	q := `SELECT session_id FROM refresh_tokens WHERE token_hash = ?`
+	err := m.DB.QueryRow(q, tokenHash).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrNoRecord
+	}
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Revoke ends the session. Its access tokens stop being accepted and its
+// refresh tokens can no longer be rotated.
+func (m *SessionModel) Revoke(id int) error {
+	q := `UPDATE sessions SET revoked_at = UTC_TIMESTAMP() WHERE id = ? AND revoked_at IS NULL`
+	_, err := m.DB.Exec(q, id)
+	return err
+}
+
+// Active reports whether the session exists and has not been revoked.
+func (m *SessionModel) Active(id int) (bool, error) {
+	var active bool
+	q := `SELECT EXISTS(SELECT true FROM sessions WHERE id = ? AND revoked_at IS NULL)`
+	err := m.DB.QueryRow(q, id).Scan(&active)
+	if err != nil {
+		return false, err
+	}
+	return active, nil
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"database/sql"
+)
+
+// ThreadFollowerModel records which users follow the thread of a message.
+// Thread replies are only pushed live to followers.
+type ThreadFollowerModel struct {
+	DB *sql.DB
+}
+
+// Follow makes the user follow the thread. Following twice is not an error.
+func (m *ThreadFollowerModel) Follow(messageID, userID int) error {
+	q := `INSERT IGNORE INTO thread_followers (message_id, user_id, created) VALUES (?, ?, UTC_TIMESTAMP())`
+	_, err := m.DB.Exec(q, messageID, userID)
+	return err
+}
+
+func (m *ThreadFollowerModel) Unfollow(messageID, userID int) error {
+	q := `DELETE FROM thread_followers WHERE message_id = ? AND user_id = ?`
+	_, err := m.DB.Exec(q, messageID, userID)
+	return err
+}
+
+func (m *ThreadFollowerModel) GetUserIDs(messageID int) ([]int, error) {
+	q := `SELECT user_id FROM thread_followers WHERE message_id = ?`
+	rows, err := m.DB.Query(q, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -13,6 +14,10 @@ type User struct {
 	Email          string
 	HashedPassword []byte
 	Created        time.Time
+	// IsBot marks bot users. Bots have no password and act through API
+	// tokens; OwnerID is the user who created the bot.
+	IsBot   bool
+	OwnerID *int
 }
 
 type UserModel struct {
@@ -42,7 +47,7 @@ func (m *UserModel) Authenticate(email, password string) (int, error) {
 	var id int
 	var hashedPassword []byte
 
-	q := `SELECT id, hashed_password FROM users WHERE email = ?`
+	q := `SELECT id, hashed_password FROM users WHERE email = ? AND is_bot = FALSE`
 	err := m.DB.QueryRow(q, email).Scan(&id, &hashedPassword)
 	if err == sql.ErrNoRows {
 		return 0, ErrInvalidCredentials
@@ -92,3 +97,123 @@ func (m *UserModel) ExistsUsername(username string) (bool, error) {
 	}
 	return exists, nil
 }
+
+func (m *UserModel) UpdateLastSeen(id int, lastSeen time.Time) error {
+	q := `UPDATE users SET last_seen = ? WHERE id = ?`
+	_, err := m.DB.Exec(q, lastSeen, id)
+	return err
+}
+
+// GetLastSeen returns the last_seen time of each of the given users. Users
+// that have never connected are left out of the map.
+func (m *UserModel) GetLastSeen(ids []int) (map[int]time.Time, error) {
+	lastSeen := make(map[int]time.Time)
+	if len(ids) == 0 {
+		return lastSeen, nil
+	}
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	q := `SELECT id, last_seen FROM users WHERE last_seen IS NOT NULL AND id IN (?` +
+		strings.Repeat(", ?", len(ids)-1) + `)`
+	rows, err := m.DB.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var t time.Time
+		if err := rows.Scan(&id, &t); err != nil {
+			return nil, err
+		}
+		lastSeen[id] = t
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return lastSeen, nil
+}
+
+func (m *UserModel) Get(id int) (*User, error) {
+	q := `SELECT id, username, email, created, is_bot, owner_id FROM users WHERE id = ?`
+	u, err := scanUser(m.DB.QueryRow(q, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetByUsername returns the user with the username, or ErrNoRecord.
+func (m *UserModel) GetByUsername(username string) (*User, error) {
+	q := `SELECT id, username, email, created, is_bot, owner_id FROM users WHERE username = ?`
+	u, err := scanUser(m.DB.QueryRow(q, username))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// InsertBot creates a bot user owned by ownerID. Bots cannot log in, so
+// they get no password.
+func (m *UserModel) InsertBot(ownerID int, username, email string) (int, error) {
+	q := `INSERT INTO users (username, email, hashed_password, is_bot, owner_id, created)
+          VALUES (?, ?, '', TRUE, ?, UTC_TIMESTAMP())`
+	result, err := m.DB.Exec(q, username, email, ownerID)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// GetBots returns the bots owned by the user, oldest first.
+func (m *UserModel) GetBots(ownerID int) ([]*User, error) {
+	q := `SELECT id, username, email, created, is_bot, owner_id FROM users
+          WHERE owner_id = ? AND is_bot = TRUE ORDER BY id`
+	rows, err := m.DB.Query(q, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := []*User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		bots = append(bots, u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return bots, nil
+}
+
+func scanUser(row scanner) (*User, error) {
+	var u User
+	var ownerID sql.NullInt64
+	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.Created, &u.IsBot, &ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if ownerID.Valid {
+		id := int(ownerID.Int64)
+		u.OwnerID = &id
+	}
+	return &u, nil
+}
@@ -0,0 +1,106 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"go.chat/internal/models"
+)
+
+// snippetWidth is the length in runes of the excerpts returned with hits.
+const snippetWidth = 160
+
+// MySQLEngine searches messages with the FULLTEXT index on their content.
+// MySQL keeps the index up to date itself, so Index and Remove do nothing.
+type MySQLEngine struct {
+	DB *sql.DB
+}
+
+// Search matches every term of the query as a word prefix, in boolean mode,
+// and orders hits by relevance, newest first among equals. Without terms
+// every hit scores the same.
+func (e *MySQLEngine) Search(ctx context.Context, q Query) (*Results, error) {
+	terms := Terms(q.Text)
+	if len(q.ChatIDs) == 0 {
+		return &Results{Hits: []*Hit{}}, nil
+	}
+
+	score := "0"
+	var args []any
+	where := `m.deleted_at IS NULL AND m.is_system = FALSE
+          AND m.chat_id IN (?` + strings.Repeat(", ?", len(q.ChatIDs)-1) + `)`
+	if len(terms) > 0 {
+		against := "+" + strings.Join(terms, "* +") + "*"
+		score = "MATCH(m.content) AGAINST (? IN BOOLEAN MODE)"
+		where = score + " AND " + where
+		args = append(args, against, against)
+	}
+	for _, id := range q.ChatIDs {
+		args = append(args, id)
+	}
+	if q.SenderID > 0 {
+		where += ` AND m.sender_id = ?`
+		args = append(args, q.SenderID)
+	}
+	if q.From != nil {
+		where += ` AND m.created >= ?`
+		args = append(args, *q.From)
+	}
+	if q.To != nil {
+		where += ` AND m.created < ?`
+		args = append(args, *q.To)
+	}
+	if q.HasAttachment {
+		where += ` AND EXISTS(SELECT true FROM attachments a WHERE a.message_id = m.id)`
+	}
+	// One extra row tells whether there is another page.
+	args = append(args, q.Limit+1, q.Offset)
+
+	stmt := `SELECT m.id, m.chat_id, m.sender_id, m.parent_id, m.content, m.created,
+          ` + score + ` AS score
+          FROM messages m
+          WHERE ` + where + `
+          ORDER BY score DESC, m.id DESC LIMIT ? OFFSET ?`
+	rows, err := e.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := &Results{Hits: []*Hit{}}
+	for rows.Next() {
+		var hit Hit
+		var parentID sql.NullInt64
+		var content string
+		var score float64
+		err := rows.Scan(&hit.MessageID, &hit.ChatID, &hit.SenderID, &parentID, &content, &hit.Created, &score)
+		if err != nil {
+			return nil, err
+		}
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			hit.ParentID = &id
+		}
+		hit.Snippet = Highlight(content, terms, snippetWidth)
+		results.Hits = append(results.Hits, &hit)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(results.Hits) > q.Limit {
+		results.Hits = results.Hits[:q.Limit]
+		next := q.Offset + q.Limit
+		results.Next = &next
+	}
+	return results, nil
+}
+
+func (e *MySQLEngine) Index(ctx context.Context, m *models.Message) error {
+	return nil
+}
+
+func (e *MySQLEngine) Remove(ctx context.Context, messageID int) error {
+	return nil
+}
@@ -0,0 +1,126 @@
+// Package search finds messages by their content. Engine hides the index
+// behind a small interface so MySQL's FULLTEXT search can be replaced by a
+// dedicated search engine.
+package search
+
+import (
+	"context"
+	"html"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.chat/internal/models"
+)
+
+// Query describes a search. Only messages in ChatIDs are considered, so the
+// caller decides which chats the user may search. From and To bound the
+// creation time of the messages, To being exclusive. A Text without terms
+// matches every message passing the other filters.
+type Query struct {
+	Text          string
+	ChatIDs       []int
+	SenderID      int
+	From          *time.Time
+	To            *time.Time
+	HasAttachment bool
+	Offset        int
+	Limit         int
+}
+
+// Hit is a message matching a query. Snippet is an HTML-escaped excerpt of
+// the message with the matched words wrapped in <mark> tags.
+type Hit struct {
+	MessageID int       `json:"id"`
+	ChatID    int       `json:"chat_id"`
+	SenderID  int       `json:"sender_id"`
+	ParentID  *int      `json:"parent_id,omitempty"`
+	Created   time.Time `json:"created"`
+	Snippet   string    `json:"snippet"`
+}
+
+// Results holds a page of hits, best first, or newest first for queries
+// without terms. Next is the offset of the next
+// page, or nil if there is none.
+type Results struct {
+	Hits []*Hit
+	Next *int
+}
+
+type Engine interface {
+	Search(ctx context.Context, q Query) (*Results, error)
+	// Index adds a new or edited message to the index.
+	Index(ctx context.Context, m *models.Message) error
+	// Remove drops a deleted message from the index.
+	Remove(ctx context.Context, messageID int) error
+}
+
+// Terms splits text into the lower-cased words that are searched for.
+// Anything but letters and digits separates words, so the result is safe to
+// embed in engine specific query syntax.
+func Terms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Highlight returns an excerpt of about width runes of content around the
+// first word starting with one of terms, HTML-escaped, with every such word
+// wrapped in <mark> tags.
+func Highlight(content string, terms []string, width int) string {
+	runes := []rune(content)
+	type word struct{ start, end int }
+	var matches []word
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && isWordRune(runes[j]) {
+			j++
+		}
+		w := strings.ToLower(string(runes[i:j]))
+		for _, t := range terms {
+			if strings.HasPrefix(w, t) {
+				matches = append(matches, word{i, j})
+				break
+			}
+		}
+		i = j
+	}
+
+	start, end := 0, len(runes)
+	if len(runes) > width {
+		if len(matches) > 0 {
+			start = max(0, matches[0].start-width/4)
+		}
+		end = min(len(runes), start+width)
+		start = max(0, end-width)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, m := range matches {
+		if m.start < start || m.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(runes[pos:m.start])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(runes[m.start:m.end])))
+		b.WriteString("</mark>")
+		pos = m.end
+	}
+	b.WriteString(html.EscapeString(string(runes[pos:end])))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
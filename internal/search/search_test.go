@@ -0,0 +1,119 @@
+package search
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{name: "Words", text: "Hello World", want: []string{"hello", "world"}},
+		{name: "Punctuation", text: "deploy, v2.1!", want: []string{"deploy", "v2", "1"}},
+		{name: "Query syntax", text: `+foo -"bar" baz*`, want: []string{"foo", "bar", "baz"}},
+		{name: "Unicode", text: "Crème brûlée", want: []string{"crème", "brûlée"}},
+		{name: "Empty", text: "  ?! ", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Terms(tt.text)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		terms   []string
+		width   int
+		want    string
+	}{
+		{
+			name:    "Whole word",
+			content: "deploy the api",
+			terms:   []string{"api"},
+			width:   100,
+			want:    "deploy the <mark>api</mark>",
+		},
+		{
+			name:    "Prefix and case",
+			content: "Deploying now, deployed later",
+			terms:   []string{"deploy"},
+			width:   100,
+			want:    "<mark>Deploying</mark> now, <mark>deployed</mark> later",
+		},
+		{
+			name:    "Inside a word",
+			content: "redeploy",
+			terms:   []string{"deploy"},
+			width:   100,
+			want:    "redeploy",
+		},
+		{
+			name:    "Several terms",
+			content: "ship it to prod",
+			terms:   []string{"ship", "prod"},
+			width:   100,
+			want:    "<mark>ship</mark> it to <mark>prod</mark>",
+		},
+		{
+			name:    "HTML escaped",
+			content: "<b>go</b> & run",
+			terms:   []string{"run"},
+			width:   100,
+			want:    "&lt;b&gt;go&lt;/b&gt; &amp; <mark>run</mark>",
+		},
+		{
+			name:    "Excerpt around the match",
+			content: "one two three four five six seven eight nine ten",
+			terms:   []string{"seven"},
+			width:   20,
+			want:    "… six <mark>seven</mark> eight nin…",
+		},
+		{
+			name:    "Excerpt at the start",
+			content: "one two three four five six seven eight nine ten",
+			terms:   []string{"two"},
+			width:   20,
+			want:    "one <mark>two</mark> three four f…",
+		},
+		{
+			name:    "Excerpt at the end",
+			content: "one two three four five six seven eight nine ten",
+			terms:   []string{"ten"},
+			width:   20,
+			want:    "…seven eight nine <mark>ten</mark>",
+		},
+		{
+			name:    "No match",
+			content: "one two three four five six seven eight nine ten",
+			terms:   []string{"zero"},
+			width:   20,
+			want:    "one two three four f…",
+		},
+		{
+			name:    "Counts runes",
+			content: "ünïcödé wörds",
+			terms:   []string{"wö"},
+			width:   13,
+			want:    "ünïcödé <mark>wörds</mark>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Highlight(tt.content, tt.terms, tt.width)
+			if got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+// Package storage holds the contents of message attachments. Metadata lives
+// in the database; a BlobStore only maps opaque keys to bytes, so it can be
+// backed by the local filesystem or an S3-compatible object store.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrNotFound = errors.New("storage: blob not found")
+
+// BlobStore stores blobs under keys made of slash separated path segments.
+type BlobStore interface {
+	// Put stores size bytes read from r under key, replacing any existing
+	// blob.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the blob stored under key. It returns ErrNotFound if there is
+	// none.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob stored under key. Deleting a missing blob is
+	// not an error.
+	Delete(ctx context.Context, key string) error
+}
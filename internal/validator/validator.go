@@ -9,7 +9,7 @@ import (
 var EmailRX = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
 
 type Validator struct {
-	FieldErrors map[string]string
+	FieldErrors map[string]string `json:"-"`
 }
 
 func (v *Validator) Valid() bool {
@@ -46,3 +46,64 @@ func MinChars(value string, n int) bool {
 func Matches(rx *regexp.Regexp, s string) bool {
 	return rx.MatchString(s)
 }
+
+// IsEmoji reports whether s is a single emoji of at most maxRunes code
+// points, including sequences joined with zero width joiners, flags, keycaps
+// and skin tone modifiers.
+func IsEmoji(s string, maxRunes int) bool {
+	if s == "" || utf8.RuneCountInString(s) > maxRunes {
+		return false
+	}
+
+	// next is set when a pictograph may come: at the start, after a zero
+	// width joiner and after the first regional indicator of a flag.
+	pictographs, indicators := 0, 0
+	next := true
+	for i, r := range s {
+		switch {
+		case r == 0x200D: // zero width joiner
+			if next {
+				return false
+			}
+			next = true
+		case r == 0xFE0F, // emoji presentation selector
+			r >= 0x1F3FB && r <= 0x1F3FF, // skin tone modifiers
+			r >= 0xE0020 && r <= 0xE007F: // tag sequences
+		case r == 0x20E3: // combining keycap
+			if i == 0 {
+				return false
+			}
+		case r >= '0' && r <= '9', r == '#', r == '*':
+			// Only valid as the base of a keycap sequence.
+			if i != 0 || !strings.HasSuffix(s, "\u20e3") {
+				return false
+			}
+			pictographs++
+			next = false
+		case r >= 0x1F1E6 && r <= 0x1F1FF: // regional indicators, paired into flags
+			if !next {
+				return false
+			}
+			pictographs++
+			indicators++
+			next = indicators%2 == 1
+		case r >= 0x1F000 && r <= 0x1FAFF,
+			r >= 0x2600 && r <= 0x27BF,
+			r >= 0x2190 && r <= 0x21FF,
+			r >= 0x2300 && r <= 0x23FF,
+			r >= 0x2B00 && r <= 0x2BFF,
+			r >= 0x2900 && r <= 0x297F,
+			r == 0x00A9, r == 0x00AE, r == 0x203C, r == 0x2049, r == 0x2122,
+			r == 0x2139, r == 0x24C2, r == 0x3030, r == 0x303D, r == 0x3297, r == 0x3299:
+			if !next {
+				return false
+			}
+			pictographs++
+			indicators = 0
+			next = false
+		default:
+			return false
+		}
+	}
+	return pictographs > 0 && !next
+}
@@ -0,0 +1,43 @@
+package validator
+
+import "testing"
+
+func TestIsEmoji(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     string
+		max   int
+		valid bool
+	}{
+		{name: "Pictograph", s: "👍", max: 16, valid: true},
+		{name: "Presentation selector", s: "❤️", max: 16, valid: true},
+		{name: "Skin tone", s: "👍🏽", max: 16, valid: true},
+		{name: "ZWJ sequence", s: "👨‍👩‍👧", max: 16, valid: true},
+		{name: "ZWJ with selector", s: "🏳️‍🌈", max: 16, valid: true},
+		{name: "Flag", s: "🇫🇷", max: 16, valid: true},
+		{name: "Subdivision flag", s: "🏴󠁧󠁢󠁳󠁣󠁴󠁿", max: 16, valid: true},
+		{name: "Keycap", s: "1️⃣", max: 16, valid: true},
+		{name: "Keycap without selector", s: "#⃣", max: 16, valid: true},
+		{name: "Symbol", s: "©", max: 16, valid: true},
+		{name: "Empty", s: "", max: 16},
+		{name: "Letter", s: "a", max: 16},
+		{name: "Bare digit", s: "1", max: 16},
+		{name: "Keycap of two digits", s: "12⃣", max: 16},
+		{name: "Lone keycap", s: "⃣", max: 16},
+		{name: "Text with emoji", s: "ok👍", max: 16},
+		{name: "Two emoji", s: "👍👍", max: 16},
+		{name: "Two flags", s: "🇫🇷🇩🇪", max: 16},
+		{name: "Lone regional indicator", s: "🇫", max: 16},
+		{name: "Leading ZWJ", s: "‍👍", max: 16},
+		{name: "Trailing ZWJ", s: "👍‍", max: 16},
+		{name: "Too many runes", s: "👨‍👩‍👧", max: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsEmoji(tt.s, tt.max); got != tt.valid {
+				t.Errorf("IsEmoji(%q, %d) = %t; want %t", tt.s, tt.max, got, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,3 @@
+-- Cursor pagination on GET /chat/messages/:chat_id walks messages by id
+-- within a chat.
+CREATE INDEX idx_messages_chat_id_id ON messages (chat_id, id);
@@ -0,0 +1,2 @@
+-- Presence tracking records when a user was last connected.
+ALTER TABLE users ADD COLUMN last_seen DATETIME NULL;
@@ -0,0 +1,2 @@
+-- Read receipts keep the last message each participant has read.
+ALTER TABLE participants ADD COLUMN last_read_message_id INT NOT NULL DEFAULT 0;
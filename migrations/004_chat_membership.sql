@@ -0,0 +1,6 @@
+-- Participants get a role so that only chat admins can remove members. Chat
+-- creators are stored as admins from now on.
+ALTER TABLE participants ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'member';
+
+-- System messages record membership changes such as a user leaving.
+ALTER TABLE messages ADD COLUMN is_system BOOLEAN NOT NULL DEFAULT FALSE;
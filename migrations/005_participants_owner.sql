@@ -0,0 +1,11 @@
+-- Chats now have an owner: the earliest admin of each chat, since creators
+-- were stored as admins, or else its earliest participant, for chats created
+-- before roles existed. Direct chats only come in 007, so every chat here is
+-- a group chat.
+UPDATE participants p
+JOIN (
+    SELECT chat_id, COALESCE(MIN(CASE WHEN role = 'admin' THEN id END), MIN(id)) AS id
+    FROM participants
+    GROUP BY chat_id
+) o ON o.id = p.id
+SET p.role = 'owner';
@@ -0,0 +1,13 @@
+-- Invite links let chat owners and admins bring users into any chat.
+CREATE TABLE invites (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    chat_id INTEGER NOT NULL,
+    created_by INTEGER NOT NULL,
+    expires DATETIME NULL,
+    max_uses INTEGER NULL,
+    uses INTEGER NOT NULL DEFAULT 0,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    created DATETIME NOT NULL
+);
+
+CREATE INDEX idx_invites_chat_id ON invites (chat_id);
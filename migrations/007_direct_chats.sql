@@ -0,0 +1,5 @@
+-- Direct conversations between two users. direct_key holds both user IDs in
+-- ascending order so that each pair has at most one conversation.
+ALTER TABLE chats ADD COLUMN is_direct BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE chats ADD COLUMN direct_key VARCHAR(64) NULL;
+CREATE UNIQUE INDEX idx_chats_direct_key ON chats (direct_key);
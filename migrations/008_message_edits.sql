@@ -0,0 +1,13 @@
+-- Messages can be edited and deleted. Deleted messages stay as tombstones.
+ALTER TABLE messages ADD COLUMN edited_at DATETIME NULL;
+ALTER TABLE messages ADD COLUMN deleted_at DATETIME NULL;
+
+-- Earlier versions of edited messages.
+CREATE TABLE message_edits (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    message_id INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    created DATETIME NOT NULL
+);
+
+CREATE INDEX idx_message_edits_message_id ON message_edits (message_id);
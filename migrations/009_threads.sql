@@ -0,0 +1,11 @@
+-- Replies to a message form its thread. Threads are one level deep.
+ALTER TABLE messages ADD COLUMN parent_id INTEGER NULL;
+CREATE INDEX idx_messages_parent_id_id ON messages (parent_id, id);
+
+-- Users who get thread replies pushed to them.
+CREATE TABLE thread_followers (
+    message_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    created DATETIME NOT NULL,
+    PRIMARY KEY (message_id, user_id)
+);
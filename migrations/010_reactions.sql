@@ -0,0 +1,8 @@
+-- Emoji reactions to messages, at most one per user, message and emoji.
+CREATE TABLE reactions (
+    message_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    emoji VARCHAR(64) NOT NULL,
+    created DATETIME NOT NULL,
+    PRIMARY KEY (message_id, user_id, emoji)
+) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,12 @@
+-- Files uploaded with a message. The contents live in the blob store under
+-- storage_key.
+CREATE TABLE attachments (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    message_id INTEGER NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL,
+    storage_key VARCHAR(255) NOT NULL,
+    created DATETIME NOT NULL
+) CHARACTER SET utf8mb4;
+CREATE INDEX idx_attachments_message_id ON attachments (message_id);
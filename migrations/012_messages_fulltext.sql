@@ -0,0 +1,2 @@
+-- Full-text search over message content.
+ALTER TABLE messages ADD FULLTEXT INDEX ft_messages_content (content);
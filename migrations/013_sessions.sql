@@ -0,0 +1,19 @@
+-- A session is a login. Its refresh tokens are rotated on every use; only
+-- their SHA-256 hashes are stored.
+CREATE TABLE sessions (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    created DATETIME NOT NULL,
+    revoked_at DATETIME NULL
+);
+
+CREATE TABLE refresh_tokens (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    session_id INTEGER NOT NULL,
+    token_hash CHAR(64) NOT NULL,
+    created DATETIME NOT NULL,
+    expires DATETIME NOT NULL,
+    used_at DATETIME NULL
+);
+CREATE UNIQUE INDEX idx_refresh_tokens_token_hash ON refresh_tokens (token_hash);
+CREATE INDEX idx_refresh_tokens_session_id ON refresh_tokens (session_id);
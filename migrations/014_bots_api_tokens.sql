@@ -0,0 +1,24 @@
+-- Bots are users without a password, owned by the user who created them.
+-- They act through API tokens, as can any user. Only the SHA-256 hashes of
+-- API tokens are stored; scopes is a space-separated list.
+ALTER TABLE users ADD COLUMN is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN owner_id INTEGER NULL;
+CREATE INDEX idx_users_owner_id ON users (owner_id);
+
+-- Messages keep the sender's bot flag so they can be told apart without a
+-- join.
+ALTER TABLE messages ADD COLUMN is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE api_tokens (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    token_hash CHAR(64) NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    created DATETIME NOT NULL,
+    expires DATETIME NULL,
+    last_used DATETIME NULL,
+    revoked_at DATETIME NULL
+);
+CREATE UNIQUE INDEX idx_api_tokens_token_hash ON api_tokens (token_hash);
+CREATE INDEX idx_api_tokens_user_id ON api_tokens (user_id);
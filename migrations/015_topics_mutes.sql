@@ -0,0 +1,4 @@
+-- Chat topics and per-member mutes, set with the /topic and /mute slash
+-- commands. A muted member cannot post until muted_until.
+ALTER TABLE chats ADD COLUMN topic VARCHAR(250) NOT NULL DEFAULT '';
+ALTER TABLE participants ADD COLUMN muted_until DATETIME NULL;